@@ -2,24 +2,62 @@
 package ftp
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/textproto"
 	"net/url"
 	"os"
+	"os/exec"
 	"path"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/jlaffaye/ftp"
 	"github.com/ncw/rclone/fs"
 	"github.com/ncw/rclone/fs/config"
 	"github.com/ncw/rclone/fs/config/obscure"
+	"github.com/ncw/rclone/fs/fserrors"
 	"github.com/ncw/rclone/fs/hash"
+	"github.com/ncw/rclone/fs/walk"
+	"github.com/ncw/rclone/lib/ftp"
+	"github.com/ncw/rclone/lib/pacer"
 	"github.com/ncw/rclone/lib/readers"
 	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/net/proxy"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/time/rate"
 )
 
+const (
+	minSleep       = 10 * time.Millisecond
+	maxSleep       = 2 * time.Second
+	decayConstant  = 2 // bigger for slower decay, exponential
+	defaultRetries = 3 // default number of tries for an operation
+
+	defaultConnectRetries = 3 // default number of retries when the server is busy
+)
+
+// connectRetrySleep is the time to wait before retrying a connection
+// to a busy server, doubled for each retry
+var connectRetrySleep = time.Second
+
+// tolerantCloseTimeout is how long to wait with tolerant_close for
+// the final reply to a transfer before assuming it isn't coming
+var tolerantCloseTimeout = 5 * time.Second
+
 // Register with Fs
 func init() {
 	fs.Register(&fs.RegInfo{
@@ -29,7 +67,7 @@ func init() {
 		Options: []fs.Option{
 			{
 				Name:     "host",
-				Help:     "FTP host to connect to",
+				Help:     "FTP host to connect to, optionally with :port on the end",
 				Optional: false,
 				Examples: []fs.OptionExample{{
 					Value: "ftp.example.com",
@@ -41,29 +79,709 @@ func init() {
 				Optional: true,
 			}, {
 				Name:     "port",
-				Help:     "FTP port, leave blank to use default (21) ",
+				Help:     "FTP port, leave blank to use the port in host or the default, 21 or 990 with tls",
 				Optional: true,
 			}, {
 				Name:       "pass",
 				Help:       "FTP password",
 				IsPassword: true,
 				Optional:   false,
+			}, {
+				Name:     "pass_env",
+				Help:     "Name of an environment variable to read the password from instead of pass, leave blank to use pass",
+				Optional: true,
+			}, {
+				Name:     "pass_command",
+				Help:     "Command to run to get the password, eg from a secrets manager, instead of pass.  Its output is the password.  Leave blank to use pass",
+				Optional: true,
+			}, {
+				Name:     "account",
+				Help:     "FTP account, sent with ACCT for servers which ask for one at login",
+				Optional: true,
+			}, {
+				Name:     "login_mode",
+				Help:     "Commands to log in with, for servers which need a login sequence other than USER then PASS",
+				Optional: true,
+				Examples: []fs.OptionExample{{
+					Value: "user_pass",
+					Help:  "USER then PASS if asked for, then ACCT if asked for (the default)",
+				}, {
+					Value: "user",
+					Help:  "USER only, eg for servers which authenticate with client_cert, then ACCT if asked for",
+				}, {
+					Value: "user_pass_acct",
+					Help:  "USER, PASS then always ACCT",
+				}, {
+					Value: "user_acct_pass",
+					Help:  "USER, ACCT then PASS",
+				}},
+			}, {
+				Name:     "tls",
+				Help:     "Use implicit FTPS (FTP over TLS) where the connection is encrypted from the start, usually on port 990",
+				Optional: true,
+			}, {
+				Name:     "explicit_tls",
+				Help:     "Use explicit FTPS where the connection is upgraded to TLS with AUTH TLS",
+				Optional: true,
+			}, {
+				Name:     "tls_data_protection",
+				Help:     "Protection level of the data connections when using FTPS",
+				Optional: true,
+				Examples: []fs.OptionExample{{
+					Value: "private",
+					Help:  "Encrypt the data connections (default)",
+				}, {
+					Value: "clear",
+					Help:  "Don't encrypt the data connections, only the control connection",
+				}},
+			}, {
+				Name:     "no_check_certificate",
+				Help:     "Don't verify the TLS certificate of the server",
+				Optional: true,
+			}, {
+				Name:     "ca_cert",
+				Help:     "PEM file of CA certificates to verify the TLS certificate of the server with, or the PEM itself, leave blank to use the system ones",
+				Optional: true,
+			}, {
+				Name:     "client_cert",
+				Help:     "PEM file of a TLS client certificate and its private key to authenticate to FTPS servers with, or the PEM itself, leave blank to not send one",
+				Optional: true,
+			}, {
+				Name:     "tls_min_version",
+				Help:     "Minimum TLS version to use for FTPS, eg 1.2, leave blank for the Go default",
+				Optional: true,
+			}, {
+				Name:     "tls_max_version",
+				Help:     "Maximum TLS version to use for FTPS, eg 1.2, leave blank for the Go default",
+				Optional: true,
+			}, {
+				Name:     "tls_server_name",
+				Help:     "Name to verify the TLS certificate of the server against and send with SNI, leave blank to use the host",
+				Optional: true,
+			}, {
+				Name:     "connect_timeout",
+				Help:     "Timeout for connecting to the FTP server, leave blank to use the global --contimeout",
+				Optional: true,
+			}, {
+				Name:     "idle_timeout",
+				Help:     "Close pooled connections which have been idle this long, leave blank to use the global --timeout, 0 to never close them",
+				Optional: true,
+			}, {
+				Name:     "data_timeout",
+				Help:     "Fail transfers whose data connection makes no progress for this long, leave blank to use the global --timeout, 0 to wait forever",
+				Optional: true,
+			}, {
+				Name:     "command_timeout",
+				Help:     "Fail commands on the control connection, eg SIZE or MDTM, which get no reply for this long and close the connection, leave blank or 0 to wait forever",
+				Optional: true,
+			}, {
+				Name:     "tolerant_close",
+				Help:     "Treat transfers as complete if all the data was sent but the server closes the data connection without replying 226 Transfer complete",
+				Optional: true,
+			}, {
+				Name:     "tcp_keepalive",
+				Help:     "Period of the TCP keep-alive probes on the connections to the server, leave blank for the system default, 0 to turn them off",
+				Optional: true,
+			}, {
+				Name:     "bandwidth_limit",
+				Help:     "Bandwidth limit in kBytes/s, or use suffix b|k|M|G, for all the uploads and downloads of the remote together, leave blank for no limit",
+				Optional: true,
+			}, {
+				Name:     "bind_address",
+				Help:     "Local IP address to make connections from, leave blank to use the global --bind",
+				Optional: true,
+			}, {
+				Name:     "dial_network",
+				Help:     "Address family to connect to the server with, for hosts with both IPv4 and IPv6 addresses where one doesn't work well for FTP",
+				Optional: true,
+				Examples: []fs.OptionExample{{
+					Value: "tcp",
+					Help:  "Either, as the system prefers (the default)",
+				}, {
+					Value: "tcp4",
+					Help:  "IPv4 only",
+				}, {
+					Value: "tcp6",
+					Help:  "IPv6 only",
+				}},
+			}, {
+				Name:     "socks_proxy",
+				Help:     "SOCKS5 proxy to connect through as [user:pass@]host:port, leave blank to connect directly",
+				Optional: true,
+			}, {
+				Name:     "force_control_ip",
+				Help:     "Make data connections to the address of the control connection rather than the one in the PASV reply, for servers behind NAT which give out their private address",
+				Optional: true,
+			}, {
+				Name:     "active_mode",
+				Help:     "Use active mode for data connections: rclone listens and the server connects to it, for servers which can't be reached for passive mode",
+				Optional: true,
+			}, {
+				Name:     "data_port_range",
+				Help:     "Range of local ports to listen on in active mode as min-max, eg 50000-50100, leave blank to use any free port",
+				Optional: true,
+			}, {
+				Name:     "follow_symlinks",
+				Help:     "Follow symlinks to find out whether they point to files or directories, otherwise they are treated as files",
+				Optional: true,
+			}, {
+				Name:     "show_hidden",
+				Help:     "List directories with LIST -a to see hidden files, for servers which leave out dotfiles from a plain LIST",
+				Optional: true,
+			}, {
+				Name:     "use_cwd_listing",
+				Help:     "Set to list directories by changing into them with CWD then using LIST without a path, for servers which only list the working directory.  This is used automatically if LIST with a path fails but this works.",
+				Optional: true,
+			}, {
+				Name:     "timezone",
+				Help:     "Time zone of the times in the server's directory listings, eg Europe/Berlin or +02:00, leave blank for UTC",
+				Optional: true,
+			}, {
+				Name:     "list_parser",
+				Help:     "Format of the server's LIST output to parse it as, for servers whose listings are misread, leave blank to detect it for each line",
+				Optional: true,
+				Examples: []fs.OptionExample{{
+					Value: "unix",
+					Help:  "Unix ls -l style",
+				}, {
+					Value: "windows",
+					Help:  "Windows and MS-DOS DIR style",
+				}, {
+					Value: "vms",
+					Help:  "OpenVMS",
+				}, {
+					Value: "netware",
+					Help:  "Novell NetWare",
+				}, {
+					Value: "os400",
+					Help:  "IBM i (OS/400)",
+				}},
+			}, {
+				Name:     "disable_mlsd",
+				Help:     "Ignore MLSD and MLST support advertised by the server and list with LIST, for servers which send broken MLSD listings",
+				Optional: true,
+			}, {
+				Name:     "trailing_slash",
+				Help:     "Whether to send directory paths to the server with a trailing slash, for servers which are picky about it",
+				Optional: true,
+				Examples: []fs.OptionExample{{
+					Value: "strip",
+					Help:  "Send them without, eg /foo (the default)",
+				}, {
+					Value: "keep",
+					Help:  "Send them with, eg /foo/",
+				}, {
+					Value: "auto",
+					Help:  "Try without then with on the first directory command and use whichever works",
+				}},
+			}, {
+				Name:     "case_insensitive",
+				Help:     "Set if the server treats file names which differ only in case as the same file, as servers on Windows and macOS usually do",
+				Optional: true,
+			}, {
+				Name:     "encoding",
+				Help:     "Character set the server uses for file names if not UTF-8, eg windows-1252 or shift_jis, leave blank for UTF-8",
+				Optional: true,
+			}, {
+				Name:     "path_prefix",
+				Help:     "Path to put before the root of every remote path, eg /mnt/share for servers which keep the files under a fixed directory, leave blank for none",
+				Optional: true,
+			}, {
+				Name:     "create_root",
+				Help:     "Create the root directory and any parents if it doesn't exist yet when the remote is opened",
+				Optional: true,
+			}, {
+				Name:     "root_is_relative",
+				Help:     "Change into the root directory with CWD on each connection and use paths relative to it, for servers which don't accept absolute paths",
+				Optional: true,
+			}, {
+				Name:     "ascii",
+				Help:     "Transfer files in ASCII mode (TYPE A) for servers which only accept text.  This corrupts binary files so only set it if needed",
+				Optional: true,
+			}, {
+				Name:     "ascii_line_ending",
+				Help:     "Line ending of the local copies of files transferred in ASCII mode, lf (the default) to convert them to and from the CRLF sent over FTP or crlf to leave them alone",
+				Optional: true,
+			}, {
+				Name:     "atomic_upload",
+				Help:     "Upload files to a temporary name and rename them into place when complete so partial files are never seen",
+				Optional: true,
+			}, {
+				Name:     "cleanup_pattern",
+				Help:     "Glob pattern matching the names of leftover temporary files to remove with cleanup, default \"*.rclone-tmp-*\"",
+				Optional: true,
+			}, {
+				Name:     "verify_upload",
+				Help:     "Check the size of each file on the server after uploading it and retry the upload if it doesn't match",
+				Optional: true,
+			}, {
+				Name:     "chunk_upload",
+				Help:     "Upload files larger than this in segments of this size stored at the same time and joined with SITE CONCAT on servers which support it, eg \"100M\"",
+				Optional: true,
+			}, {
+				Name:     "read_only",
+				Help:     "Refuse to change anything on the server, only allowing listing and reading files",
+				Optional: true,
+			}, {
+				Name:     "chmod",
+				Help:     "Permissions to set on uploaded files with SITE CHMOD as an octal mode, eg 644, leave blank to leave them alone",
+				Optional: true,
+			}, {
+				Name:     "umask",
+				Help:     "Octal umask to set with SITE UMASK after logging in, eg 022, so new files and directories get permissions without its bits, leave blank to use the server's",
+				Optional: true,
+			}, {
+				Name:     "no_pool",
+				Help:     "Use a new connection for each operation and close it afterwards rather than reusing connections, for servers which misbehave with reused connections",
+				Optional: true,
+			}, {
+				Name:     "disable_connection_reset",
+				Help:     "Close connections whose working directory or transfer type was changed instead of resetting them with CWD and TYPE I",
+				Optional: true,
+			}, {
+				Name:     "retries",
+				Help:     "Number of tries for an operation which fails with a connection error, leave blank to use the default (3)",
+				Optional: true,
+			}, {
+				Name:     "connect_retries",
+				Help:     "Number of times to retry connecting when the server is busy, leave blank to use the default (3)",
+				Optional: true,
+			}, {
+				Name:     "concurrency",
+				Help:     "Maximum number of FTP connections to use at once, leave blank or 0 for unlimited",
+				Optional: true,
+			}, {
+				Name:     "max_connections_per_host",
+				Help:     "Maximum number of FTP connections open to the server as this user by all the remotes which set it, including idle ones, leave blank or 0 for unlimited",
+				Optional: true,
+			}, {
+				Name:     "pool_min",
+				Help:     "Number of connections to keep open and ready in the pool, dialing new ones when they die, leave blank or 0 for none",
+				Optional: true,
+			}, {
+				Name:     "pool_max",
+				Help:     "Maximum number of FTP connections to have open at once, in use or idle, leave blank or 0 for unlimited",
+				Optional: true,
+			}, {
+				Name:     "max_list_depth",
+				Help:     "Maximum depth of directories to list recursively with --fast-list before giving up, leave blank or 0 for unlimited",
+				Optional: true,
 			},
 		},
 	})
 }
 
+// errorReadOnly is returned by the operations which would change
+// the server when read_only is set
+var errorReadOnly = errors.New("remote is read only")
+
+// errorControlCharacters is returned for paths containing control
+// characters such as line breaks, which can't be sent in FTP commands
+// as the server could read them as more than one command
+var errorControlCharacters = errors.New("paths with control characters can't be used over FTP")
+
+// checkPath returns errorControlCharacters if path contains control
+// characters other than tab.  Commands containing them are refused
+// by the ftp library anyway but this catches them before the
+// operations which only look for the path in a listing.
+func checkPath(path string) error {
+	if strings.IndexFunc(path, func(r rune) bool { return r < ' ' && r != '\t' }) >= 0 {
+		return errorControlCharacters
+	}
+	return nil
+}
+
 // Fs represents a remote FTP server
 type Fs struct {
-	name     string       // name of this remote
-	root     string       // the path we are working on if any
-	features *fs.Features // optional features
-	url      string
-	user     string
-	pass     string
-	dialAddr string
-	poolMu   sync.Mutex
-	pool     []*ftp.ServerConn
+	name           string       // name of this remote
+	root           string       // the path we are working on if any
+	prefix         string       // path_prefix to put before root if set
+	cwd            string       // directory to change into on connecting if root_is_relative is set
+	features       *fs.Features // optional features
+	url            string
+	user           string
+	pass           string
+	account        string
+	loginSteps     []string
+	dialAddr       string
+	*connPool                   // connections, shared with other Fs using the same server
+	pacer          *pacer.Pacer // pacer for retrying operations
+	serverFeatures featureSet   // features advertised by the server
+	statSupport    int32        // whether STAT lists paths, see statSTAT, use atomically
+	cwdListing     int32        // set to list directories with CWD then LIST, use atomically
+	trailingSlash  int32        // how to send directory paths, see slashStrip, use atomically
+
+	connectTimeout time.Duration // timeout for dialing the server
+	idleTimeout    time.Duration // close pooled connections idle this long
+	dataTimeout    time.Duration // fail transfers making no progress for this long if set
+	commandTimeout time.Duration // fail commands with no reply for this long if set
+	tolerantClose  bool          // accept transfers with all the data but no final reply
+	keepAlive      time.Duration // TCP keep-alive period as for net.Dialer.KeepAlive
+	bwLimit        *rate.Limiter // shared by the transfers to limit their bandwidth if set
+	bindAddress    net.IP        // local address to dial from if set
+	socksProxy     string        // address of the SOCKS5 proxy if set
+	socksAuth      *proxy.Auth   // credentials for the SOCKS5 proxy if any
+	dial           DialFunc      // used to open connections to the server
+	dialNetwork    string        // network to dial, "tcp4" or "tcp6" to force the address family
+	forceControlIP bool          // ignore the address in PASV replies
+	activeMode     bool          // listen for data connections rather than using passive mode
+	dataPortMin    int           // lowest local port to listen on in active mode if set
+	dataPortMax    int           // highest local port to listen on in active mode if set
+	noReset        bool          // close changed connections rather than resetting them
+	noPool         bool          // close connections after each use rather than pooling them
+	retries        int           // number of tries for an operation which fails with a connection error
+	connectRetries int           // number of retries when the server is busy
+	concurrency    int           // maximum number of connections in use at once if set
+	maxPerHost     int           // maximum number of connections open to the server as this user if set
+	poolMin        int           // number of connections to keep open in the pool if set
+	poolMax        int           // maximum number of connections open at once if set
+	followSymlinks bool          // resolve symlinks rather than treating them as files
+	listParser     string        // format of LIST lines or "" to detect it
+	disableMLSD    bool          // ignore MLSD and MLST support and use LIST
+	system         string        // system type of the server from SYST if known
+	maxListDepth   int           // how deep ListR lists if set
+	showHidden     bool          // list with LIST -a to include dotfiles
+	ignoreCase     bool          // file names differing only in case are the same file
+	ascii          bool          // transfer files in ASCII mode rather than binary
+	asciiCRLF      bool          // don't convert line endings in ASCII mode
+	chmod          string        // octal mode to set on uploaded files if set
+	umask          string        // octal umask to set with SITE UMASK after login if set
+	atomicUpload   bool          // upload to a temporary name then rename into place
+	verifyUpload   bool          // check the size on the server after uploading
+	chunkUpload    fs.SizeSuffix // size of the segments to upload large files in if set
+	readOnly       bool          // refuse all operations which change the server
+	tempPattern    string        // glob matching the names of leftover temporary files
+	tlsConfig      *tls.Config   // TLS config if using FTPS
+	explicitTLS    bool          // upgrade the connection with AUTH TLS rather than using implicit TLS
+	dataProtection string        // PROT level for the data connections when using TLS
+
+	encoding encoding.Encoding // character set of file names if not UTF-8
+	timezone *time.Location    // time zone of the times in listings if set
+}
+
+// connPool is the pool of connections to the server.  It is shared
+// by all the Fs which connect to the same server as the same user in
+// the same way, eg for different roots on one remote.
+type connPool struct {
+	poolMu     sync.Mutex
+	pool       []*ftp.ServerConn
+	tokens     chan struct{}                  // one per connection in use if concurrency is limited
+	readTokens chan struct{}                  // one per open reader if concurrency is limited
+	stats      connStats                      // connection counters, protected by poolMu
+	state      map[*ftp.ServerConn]*connState // changed state of connections in use
+	drain      *time.Timer                    // used to close the pool when it has been idle
+	limit      *hostLimit                     // limit shared with other pools for the server if set
+	users      int                            // number of Fs using the pool, protected by connPoolsMu
+	stop       chan struct{}                  // closed to stop the pool_min maintainer, protected by poolMu
+}
+
+// newConnPool makes a connPool for f allowing f.concurrency
+// connections in use at once, or any number if it is 0.  If pool_max
+// is lower it is used instead.
+//
+// Connections are only dialed by a holder of a token while the pool
+// is empty, so limiting the connections in use limits the idle ones
+// too.
+func newConnPool(f *Fs) *connPool {
+	p := &connPool{}
+	limit := f.concurrency
+	if f.poolMax > 0 && (limit == 0 || f.poolMax < limit) {
+		limit = f.poolMax
+	}
+	if limit > 0 {
+		p.tokens = make(chan struct{}, limit)
+		// Open readers hold their connection until they are
+		// closed so leave a connection free for other operations
+		// otherwise they could wait forever for the readers.
+		maxReaders := limit - 1
+		if maxReaders < 1 {
+			maxReaders = 1
+		}
+		p.readTokens = make(chan struct{}, maxReaders)
+	}
+	if f.maxPerHost > 0 {
+		p.limit = sharedHostLimit(f.dialAddr+"\x00"+f.user, f.maxPerHost)
+		p.limit.pools = append(p.limit.pools, p)
+	}
+	return p
+}
+
+// hostLimit limits the number of connections open to a server as
+// one user across all the connection pools for it when
+// max_connections_per_host is set.  Idle connections in the pools
+// count as they are still logged in.
+type hostLimit struct {
+	slots chan struct{} // one per open connection
+	pools []*connPool   // pools using the limit, protected by connPoolsMu
+}
+
+// connPools are the connection pools in use keyed by poolKey and
+// hostLimits are the limits in use keyed by server address and user
+var (
+	connPoolsMu sync.Mutex
+	connPools   = map[string]*connPool{}
+	hostLimits  = map[string]*hostLimit{}
+)
+
+// hostLimitPoll is how often to look for idle connections to close
+// while waiting for a connection slot for the server
+var hostLimitPoll = 100 * time.Millisecond
+
+// sharedHostLimit returns the limit for key allowing max connections,
+// making it if there isn't one yet.  Call with connPoolsMu held.
+//
+// The first remote to use the limit sets the maximum.
+func sharedHostLimit(key string, max int) *hostLimit {
+	h := hostLimits[key]
+	if h == nil {
+		h = &hostLimit{slots: make(chan struct{}, max)}
+		hostLimits[key] = h
+	}
+	return h
+}
+
+// closeIdle closes an idle connection in one of the pools using the
+// limit to free a slot, returning false if there are none
+func (h *hostLimit) closeIdle() bool {
+	connPoolsMu.Lock()
+	pools := h.pools
+	connPoolsMu.Unlock()
+	for _, p := range pools {
+		var c *ftp.ServerConn
+		p.poolMu.Lock()
+		if len(p.pool) > 0 {
+			c = p.pool[0]
+			p.pool = p.pool[1:]
+			p.stats.Discarded++
+		}
+		p.poolMu.Unlock()
+		if c != nil {
+			_ = c.Quit()
+			<-h.slots
+			return true
+		}
+	}
+	return false
+}
+
+// getHostSlot waits for a free slot to open a connection to the
+// server if max_connections_per_host is set, closing idle connections
+// in other pools for the server to free one.  It returns ctx.Err() if
+// ctx is done first.
+func (p *connPool) getHostSlot(ctx context.Context) error {
+	h := p.limit
+	if h == nil {
+		return nil
+	}
+	for {
+		select {
+		case h.slots <- struct{}{}:
+			return nil
+		default:
+		}
+		if h.closeIdle() {
+			continue
+		}
+		// wait for a connection to be closed or check for
+		// idle ones again later
+		select {
+		case h.slots <- struct{}{}:
+			return nil
+		case <-time.After(hostLimitPoll):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// putHostSlot frees the slot of a connection which has been closed
+func (p *connPool) putHostSlot() {
+	if p.limit != nil {
+		<-p.limit.slots
+	}
+}
+
+// tryHostSlot takes a slot to open a connection to the server without
+// waiting or closing the connections of other pools, returning false
+// if there are none free
+func (p *connPool) tryHostSlot() bool {
+	if p.limit == nil {
+		return true
+	}
+	select {
+	case p.limit.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// sharedConnPool returns the connection pool for key, making it for f
+// if there isn't one yet
+func sharedConnPool(key string, f *Fs) *connPool {
+	connPoolsMu.Lock()
+	defer connPoolsMu.Unlock()
+	p := connPools[key]
+	if p == nil {
+		p = newConnPool(f)
+		connPools[key] = p
+	}
+	p.users++
+	return p
+}
+
+// useConnPool sets f to use the shared connection pool for its
+// settings
+func (f *Fs) useConnPool() {
+	f.setConnPool(sharedConnPool(poolKey(f.name, f), f))
+}
+
+// releaseConnPool stops f using its connection pool.  If no other Fs
+// uses the pool it is forgotten and its connections closed.
+//
+// This is used when NewFs fails, or f changes pool while it is being
+// made, so connections aren't left open for an Fs which won't be
+// used.
+func (f *Fs) releaseConnPool() {
+	p := f.connPool
+	connPoolsMu.Lock()
+	p.users--
+	unused := p.users <= 0
+	if unused {
+		for key, pool := range connPools {
+			if pool == p {
+				delete(connPools, key)
+			}
+		}
+		if h := p.limit; h != nil {
+			for i, pool := range h.pools {
+				if pool == p {
+					h.pools = append(h.pools[:i:i], h.pools[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	connPoolsMu.Unlock()
+	if unused {
+		_ = f.drainPool()
+	}
+}
+
+// setConnPool sets f to use p, starting the timer to close idle
+// connections if needed
+func (f *Fs) setConnPool(p *connPool) {
+	f.connPool = p
+	f.poolMu.Lock()
+	if f.idleTimeout > 0 && f.drain == nil {
+		f.drain = time.AfterFunc(f.idleTimeout, f.expirePool)
+	}
+	f.poolMu.Unlock()
+}
+
+// poolKeyIgnore are the options which don't change how connections
+// are made so remotes which only differ in them can share them.  The
+// password options are replaced by the password itself.
+var poolKeyIgnore = map[string]bool{
+	"type":         true,
+	"host":         true,
+	"port":         true,
+	"user":         true,
+	"pass":         true,
+	"pass_env":     true,
+	"pass_command": true,
+	"path_prefix":  true,
+	"create_root":  true,
+	"read_only":    true,
+}
+
+// poolKey returns the key of the connection pool for f, the remote
+// called name.  It is made of the server address, the credentials,
+// the directory connections change into and the values of all the
+// options which affect connections.
+func poolKey(name string, f *Fs) string {
+	parts := []string{f.dialAddr, f.user, f.pass, f.cwd}
+	for _, option := range fs.MustFind("ftp").Options {
+		if !poolKeyIgnore[option.Name] {
+			parts = append(parts, option.Name+"="+config.FileGet(name, option.Name))
+		}
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// connStats counts the connections made to the server and what
+// happened to them, for diagnosing servers which drop connections.
+// They are logged at debug level when the pool is drained.
+type connStats struct {
+	Opened    int // connections made to the server
+	Reused    int // times a connection was taken from the pool
+	Discarded int // connections closed as they were dead or unusable
+	Pooled    int // connections idle in the pool now
+	InUse     int // connections in use now
+}
+
+// connStats returns a snapshot of the connection counters.  These
+// are for the connection pool so include the use by all the Fs
+// sharing it.
+func (f *Fs) connStats() connStats {
+	f.poolMu.Lock()
+	defer f.poolMu.Unlock()
+	stats := f.stats
+	stats.Pooled = len(f.pool)
+	return stats
+}
+
+// String formats the counters for the log
+func (s connStats) String() string {
+	return fmt.Sprintf("%d opened, %d reused, %d discarded, %d pooled, %d in use",
+		s.Opened, s.Reused, s.Discarded, s.Pooled, s.InUse)
+}
+
+// connState records the state of a connection which must be restored
+// before it can be returned to the pool
+type connState struct {
+	dir         string // working directory to return to if set
+	typeChanged bool   // set if the transfer type is no longer binary
+	protChanged bool   // set if the PROT level is no longer the default
+}
+
+// featureSet is the set of features advertised by the server in
+// response to FEAT, upper cased.  Features with parameters such as
+// "SITE COPY" are stored both whole and as the first word.
+type featureSet map[string]struct{}
+
+// has returns true if the server advertised feature
+func (fe featureSet) has(feature string) bool {
+	_, ok := fe[strings.ToUpper(feature)]
+	return ok
+}
+
+// remove removes feature, and the features with it as their first
+// word, as if the server hadn't advertised it
+func (fe featureSet) remove(feature string) {
+	feature = strings.ToUpper(feature)
+	for listed := range fe {
+		if listed == feature || strings.HasPrefix(listed, feature+" ") {
+			delete(fe, listed)
+		}
+	}
+}
+
+// hasFact returns true if the server advertised command, eg "MFF",
+// with fact among the facts it lists, eg "UNIX.mode"
+func (fe featureSet) hasFact(command, fact string) bool {
+	prefix, fact := strings.ToUpper(command)+" ", strings.ToUpper(fact)
+	for feature := range fe {
+		if !strings.HasPrefix(feature, prefix) {
+			continue
+		}
+		for _, listed := range strings.Split(feature[len(prefix):], ";") {
+			if strings.TrimSuffix(strings.TrimSpace(listed), "*") == fact {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // Object describes an FTP file
@@ -79,8 +797,17 @@ type FileInfo struct {
 	Size    uint64
 	ModTime time.Time
 	IsDir   bool
+
+	sizeUnknown bool // set if Size is 0 from a listing and should be read with SIZE
+	sizeWarned  bool // set once an implausible Size has been logged
+	roughTime   bool // set if ModTime is from a LIST line so may only be to the minute
 }
 
+// maxSize is the largest file size believed from the server.  Bigger
+// sizes are much more likely to be misparsed listings than real files
+// and past math.MaxInt64 they can't be returned by Size anyway.
+const maxSize = 1 << 60
+
 // ------------------------------------------------------------
 
 // Name of this fs
@@ -88,9 +815,69 @@ func (f *Fs) Name() string {
 	return f.name
 }
 
+// fullPath returns the path on the server of remote, which is
+// relative to the root of f
+func (f *Fs) fullPath(remote string) string {
+	return path.Join(f.prefix, f.root, remote)
+}
+
+// Values for Fs.trailingSlash
+const (
+	slashAuto  int32 = iota // not known yet, found with the first directory command
+	slashStrip              // send directory paths without a trailing slash
+	slashKeep               // send directory paths with a trailing slash
+)
+
+// slashDir returns the rooted directory path dir with a trailing
+// slash if slash is set, or without one if not.  "" for the working
+// directory and "/" are left alone.
+func slashDir(dir string, slash bool) string {
+	if dir == "" || dir == "/" {
+		return dir
+	}
+	dir = strings.TrimSuffix(dir, "/")
+	if slash {
+		dir += "/"
+	}
+	return dir
+}
+
+// dirCommand calls fn to send a command with the directory path dir,
+// which fn should pass through slashDir with slash, as trailing_slash
+// says.
+//
+// With trailing_slash auto the path is sent without a trailing slash
+// and if the server refuses that with one.  Whichever works is used
+// from then on.  Paths slashDir leaves alone don't tell.
+func (f *Fs) dirCommand(dir string, fn func(slash bool) error) error {
+	switch atomic.LoadInt32(&f.trailingSlash) {
+	case slashStrip:
+		return fn(false)
+	case slashKeep:
+		return fn(true)
+	}
+	if dir == "" || dir == "/" {
+		return fn(false)
+	}
+	err := fn(false)
+	if err == nil {
+		atomic.StoreInt32(&f.trailingSlash, slashStrip)
+		return nil
+	}
+	if _, isRegularError := errors.Cause(err).(*textproto.Error); !isRegularError {
+		return err
+	}
+	if slashErr := fn(true); slashErr != nil {
+		return err
+	}
+	fs.Debugf(f, "Directory path without a trailing slash failed so sending them with one from now on: %v", err)
+	atomic.StoreInt32(&f.trailingSlash, slashKeep)
+	return nil
+}
+
 // Root of the remote (as passed into NewFs)
 func (f *Fs) Root() string {
-	return f.root
+	return path.Join(f.cwd, f.root)
 }
 
 // String returns a description of the FS
@@ -103,124 +890,1525 @@ func (f *Fs) Features() *fs.Features {
 	return f.features
 }
 
-// Open a new connection to the FTP server.
-func (f *Fs) ftpConnection() (*ftp.ServerConn, error) {
-	fs.Debugf(f, "Connecting to FTP server")
-	c, err := ftp.DialTimeout(f.dialAddr, fs.Config.ConnectTimeout)
-	if err != nil {
-		fs.Errorf(f, "Error while Dialing %s: %s", f.dialAddr, err)
-		return nil, errors.Wrap(err, "ftpConnection Dial")
-	}
-	err = c.Login(f.user, f.pass)
-	if err != nil {
-		_ = c.Quit()
+// retryErrorCodes is a slice of FTP status codes which mean the
+// operation should be retried on a fresh connection
+var retryErrorCodes = []int{
+	ftp.StatusNotAvailable,             // 421 Service not available, closing control connection
+	ftp.StatusCanNotOpenDataConnection, // 425 Can't open data connection
+	ftp.StatusTransfertAborted,         // 426 Connection closed; transfer aborted
+}
+
+// shouldRetry returns a boolean as to whether this err deserves to be
+// retried.  It returns the err as a convenience
+//
+// Errors which aren't FTP status codes come from the connection
+// itself so are always retried unless the context was cancelled.
+func shouldRetry(err error) (bool, error) {
+	if err == nil {
+		return false, err
+	}
+	cause := errors.Cause(err)
+	if cause == context.Canceled || cause == context.DeadlineExceeded {
+		return false, err
+	}
+	if _, ok := cause.(*ftp.InvalidCommandError); ok {
+		// a path with control characters in it fails every time
+		return false, err
+	}
+	if errX, ok := cause.(*textproto.Error); ok {
+		for _, code := range retryErrorCodes {
+			if errX.Code == code {
+				return true, err
+			}
+		}
+		return false, err
+	}
+	return true, err
+}
+
+// isTimeout returns true if err is the server not replying to a
+// command, or to a transfer with tolerant_close, in time
+func isTimeout(err error) bool {
+	switch errors.Cause(err).(type) {
+	case *ftp.CommandTimeoutError, *ftp.TransferReplyTimeoutError:
+		return true
+	}
+	return false
+}
+
+// isMissingTransferReply returns true if err is the final reply to a
+// transfer not arriving after its data connection was closed, either
+// timing out with tolerant_close or the server closing the control
+// connection
+func isMissingTransferReply(err error) bool {
+	switch errors.Cause(err) {
+	case io.EOF, io.ErrUnexpectedEOF:
+		return true
+	}
+	_, ok := errors.Cause(err).(*ftp.TransferReplyTimeoutError)
+	return ok
+}
+
+// isNotAvailable returns true if err is a 421 response which the
+// server sends when it is about to close the control connection, for
+// example because it has been idle too long.  The command won't have
+// been run so it is always safe to retry.
+func isNotAvailable(err error) bool {
+	errX, ok := errors.Cause(err).(*textproto.Error)
+	return ok && errX.Code == ftp.StatusNotAvailable
+}
+
+// isNotImplemented returns true if err is the server saying it
+// doesn't understand or support a command, eg REST
+func isNotImplemented(err error) bool {
+	if errX, ok := errors.Cause(err).(*textproto.Error); ok {
+		switch errX.Code {
+		case ftp.StatusBadCommand, ftp.StatusNotImplemented, ftp.StatusNotImplementedParameter:
+			return true
+		}
+	}
+	return false
+}
+
+// DialFunc opens a network connection to address, eg through a
+// tunnel, in the same way as net.Dial
+type DialFunc func(network, address string) (net.Conn, error)
+
+// SetDialFunc sets f to open its connections to the server with dial
+// instead of directly or through socks_proxy, eg to tunnel them
+// through SSH.  It is used for the control connection and for the
+// data connections in passive mode.  The data connections are made to
+// the IP address the control connection reached unless its RemoteAddr
+// isn't a *net.TCPAddr, in which case they are made to host.
+//
+// f stops sharing connections with other remotes as theirs were
+// opened differently.  Call it before using f.
+func (f *Fs) SetDialFunc(dial DialFunc) {
+	f.dial = dial
+	f.releaseConnPool()
+	connPoolsMu.Lock()
+	p := newConnPool(f)
+	p.users++
+	connPoolsMu.Unlock()
+	f.setConnPool(p)
+}
+
+// dialDirect is the default DialFunc which connects directly or
+// through the SOCKS5 proxy if set
+func (f *Fs) dialDirect(network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: f.connectTimeout, KeepAlive: f.keepAlive}
+	if f.bindAddress != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: f.bindAddress}
+	}
+	if f.socksProxy == "" {
+		return dialer.Dial(network, address)
+	}
+	socks, err := proxy.SOCKS5("tcp", f.socksProxy, f.socksAuth, dialer)
+	if err != nil {
+		return nil, errors.Wrap(err, "SOCKS5 proxy")
+	}
+	conn, err := socks.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, addr: proxyAddr{network: network, address: address}}, nil
+}
+
+// proxyAddr is the address of the server a proxyConn is connected to
+type proxyAddr struct {
+	network string
+	address string
+}
+
+// Network returns the name of the network
+func (a proxyAddr) Network() string { return a.network }
+
+// String returns the address as it was dialled
+func (a proxyAddr) String() string { return a.address }
+
+// proxyConn is a connection through a SOCKS5 proxy.  Its RemoteAddr
+// is the address of the server rather than the proxy so the ftp
+// library makes the data connections to the server through the proxy
+// too.
+type proxyConn struct {
+	net.Conn
+	addr proxyAddr
+}
+
+// RemoteAddr returns the address of the server
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// dialWithNetwork opens connections with f.dial using the network
+// set by dial_network, so the control connection and the data
+// connections in passive mode use the address family chosen
+func (f *Fs) dialWithNetwork(network, address string) (net.Conn, error) {
+	if network == "tcp" {
+		network = f.dialNetwork
+	}
+	return f.dial(network, address)
+}
+
+// Open a new connection to the FTP server.
+func (f *Fs) ftpConnection() (*ftp.ServerConn, error) {
+	fs.Debugf(f, "Connecting to FTP server")
+	options := []ftp.DialOption{
+		// the dialer sets the timeout for active mode data connections
+		ftp.DialWithDialer(net.Dialer{Timeout: f.connectTimeout}),
+		ftp.DialWithDialFunc(f.dialWithNetwork),
+		ftp.DialWithForceListHidden(f.showHidden),
+		ftp.DialWithForceControlIP(f.forceControlIP),
+		ftp.DialWithDisabledMLSD(f.disableMLSD),
+	}
+	if f.dataTimeout > 0 {
+		options = append(options, ftp.DialWithDataTimeout(f.dataTimeout))
+	}
+	if f.commandTimeout > 0 {
+		options = append(options, ftp.DialWithCommandTimeout(f.commandTimeout))
+	}
+	if f.tolerantClose {
+		options = append(options, ftp.DialWithTransferReplyTimeout(tolerantCloseTimeout))
+	}
+	if f.timezone != nil {
+		options = append(options, ftp.DialWithLocation(f.timezone))
+	}
+	if f.listParser != "" {
+		options = append(options, ftp.DialWithListParser(f.listParser))
+	}
+	if f.activeMode {
+		options = append(options, ftp.DialWithActiveMode(f.dataPortMin, f.dataPortMax))
+	}
+	if f.encoding != nil {
+		options = append(options, ftp.DialWithEncoding(f.encoding.NewEncoder().String, f.encoding.NewDecoder().String))
+	}
+	if f.tlsConfig != nil {
+		if f.explicitTLS {
+			options = append(options, ftp.DialWithExplicitTLS(f.tlsConfig))
+		} else {
+			options = append(options, ftp.DialWithTLS(f.tlsConfig))
+		}
+	}
+	c, err := ftp.Dial(f.dialAddr, options...)
+	if err != nil {
+		fs.Errorf(f, "Error while Dialing %s: %s", f.dialAddr, err)
+		return nil, errors.Wrap(err, "ftpConnection Dial")
+	}
+	err = f.login(c)
+	if err != nil {
+		_ = c.Quit()
 		fs.Errorf(f, "Error while Logging in into %s: %s", f.dialAddr, err)
 		return nil, errors.Wrap(err, "ftpConnection Login")
 	}
+	if f.cwd != "" {
+		err = c.ChangeDir(f.cwd)
+		if err != nil {
+			_ = c.Quit()
+			return nil, errors.Wrapf(err, "ftpConnection CWD %q", f.cwd)
+		}
+	}
+	f.poolMu.Lock()
+	f.stats.Opened++
+	f.poolMu.Unlock()
 	return c, nil
 }
 
+// login logs c in with the commands set by login_mode or with USER
+// and PASS, sending the account if the server asks for it, setting
+// the PROT level if using TLS and setting the umask if set.
+//
+// Login puts the connection into binary mode with TYPE I as does
+// sendAccount so transfers are binary unless setType is used.
+func (f *Fs) login(c *ftp.ServerConn) error {
+	var err error
+	if f.loginSteps != nil {
+		err = f.loginSequence(c)
+	} else {
+		err = c.Login(f.user, f.pass)
+		if err != nil && f.account != "" && isNeedAccount(err) {
+			err = f.sendAccount(c)
+		}
+	}
+	if err == nil && f.tlsConfig != nil {
+		err = setDataProtection(c, f.dataProtection)
+	}
+	if err == nil && f.umask != "" {
+		err = f.siteUmask(c)
+	}
+	return err
+}
+
+// statusLoggedInSecurity is the reply to USER from servers which log
+// the user in with the TLS client certificate, from RFC 2228
+const statusLoggedInSecurity = 232
+
+// loginSequence logs c in by sending the commands set by login_mode
+// in order, rather than leaving it to Login.
+//
+// PASS is skipped if the server has logged the user in already, and
+// ACCT is sent if the server asks for it even if it isn't in the
+// sequence.
+func (f *Fs) loginSequence(c *ftp.ServerConn) error {
+	var (
+		loggedIn bool
+		code     int
+		message  string
+		err      error
+	)
+	send := func(step string) error {
+		switch step {
+		case "USER":
+			code, message, err = c.Quote("USER %s", f.user)
+		case "PASS":
+			code, message, err = c.Quote("PASS %s", f.pass)
+		case "ACCT":
+			code, message, err = c.Quote("ACCT %s", f.account)
+		}
+		if err != nil {
+			return err
+		}
+		switch code {
+		case ftp.StatusLoggedIn, statusLoggedInSecurity:
+			loggedIn = true
+		case ftp.StatusUserOK, ftp.StatusCommandNotImplemented:
+		case ftp.StatusLoginNeedAccount:
+			if f.account == "" {
+				return &textproto.Error{Code: code, Msg: message}
+			}
+		default:
+			return &textproto.Error{Code: code, Msg: message}
+		}
+		return nil
+	}
+	for _, step := range f.loginSteps {
+		if step == "PASS" && loggedIn {
+			continue
+		}
+		if err = send(step); err != nil {
+			return err
+		}
+	}
+	if !loggedIn && code == ftp.StatusLoginNeedAccount {
+		if err = send("ACCT"); err != nil {
+			return err
+		}
+	}
+	if !loggedIn {
+		return errors.Errorf("not logged in after login_mode %s: %d %s", strings.ToLower(strings.Join(f.loginSteps, "_")), code, message)
+	}
+	return c.FinishLogin()
+}
+
+// siteUmask sets the umask of c with SITE UMASK so files and
+// directories made with it get permissions without its bits.
+// Servers which don't support it are skipped.
+func (f *Fs) siteUmask(c *ftp.ServerConn) error {
+	code, message, err := c.Quote("SITE UMASK %s", f.umask)
+	if err != nil {
+		return err
+	}
+	err = &textproto.Error{Code: code, Msg: message}
+	switch {
+	case code == ftp.StatusCommandOK:
+		return nil
+	case isNotImplemented(err):
+		fs.Debugf(f, "Not setting umask as server doesn't support SITE UMASK: %v", err)
+		return nil
+	}
+	return errors.Wrap(err, "SITE UMASK")
+}
+
+// relogin logs c in again with REIN after the server has logged it
+// out, eg after the credentials were changed, so it can be reused
+// without dialing a new connection.
+//
+// REIN puts c back into the state it was in just after connecting
+// so it is logged in and changed into the root directory again.
+func (f *Fs) relogin(c *ftp.ServerConn) error {
+	f.poolMu.Lock()
+	delete(f.state, c)
+	f.poolMu.Unlock()
+	err := c.Logout()
+	if err != nil {
+		return errors.Wrap(err, "REIN")
+	}
+	err = f.login(c)
+	if err != nil {
+		return errors.Wrap(err, "login")
+	}
+	if f.cwd != "" {
+		err = c.ChangeDir(f.cwd)
+		if err != nil {
+			return errors.Wrapf(err, "CWD %q", f.cwd)
+		}
+	}
+	return nil
+}
+
+// isNotLoggedIn returns true if err is a 530 reply saying the
+// connection isn't logged in, rather than one refusing the
+// connection as the server is busy.
+func isNotLoggedIn(err error) bool {
+	errX, ok := errors.Cause(err).(*textproto.Error)
+	return ok && errX.Code == ftp.StatusNotLoggedIn && !isBusy(err)
+}
+
+// isBusy returns true if err is the server refusing a connection
+// because it has too many already.  This is a 421 or 425 reply or a
+// 530 one which says so as some servers use that instead.
+func isBusy(err error) bool {
+	errX, ok := errors.Cause(err).(*textproto.Error)
+	if !ok {
+		return false
+	}
+	switch errX.Code {
+	case ftp.StatusNotAvailable, ftp.StatusCanNotOpenDataConnection:
+		return true
+	case ftp.StatusNotLoggedIn:
+		msg := strings.ToLower(errX.Msg)
+		return strings.Contains(msg, "too many") || strings.Contains(msg, "maximum number")
+	}
+	return false
+}
+
+// connect opens a new connection retrying with exponential backoff
+// if the server is busy
+func (f *Fs) connect(ctx context.Context) (c *ftp.ServerConn, err error) {
+	sleep := connectRetrySleep
+	for try := 0; ; try++ {
+		c, err = f.ftpConnection()
+		if err == nil || try >= f.connectRetries || !isBusy(err) {
+			return c, err
+		}
+		fs.Debugf(f, "Server busy, retrying connection in %v (%d/%d): %v", sleep, try+1, f.connectRetries, err)
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		sleep *= 2
+	}
+}
+
+// isNeedAccount returns true if err is the server asking for an
+// account to complete the login
+func isNeedAccount(err error) bool {
+	if errX, ok := errors.Cause(err).(*textproto.Error); ok {
+		return errX.Code == ftp.StatusLoginNeedAccount
+	}
+	return false
+}
+
+// sendAccount completes a login the server replied 332 to by sending
+// the account with ACCT.
+//
+// Login stops before putting the connection into binary mode in this
+// case so that is done here too.
+func (f *Fs) sendAccount(c *ftp.ServerConn) error {
+	code, message, err := c.Quote("ACCT %s", f.account)
+	if err != nil {
+		return err
+	}
+	if code != ftp.StatusLoggedIn && code != ftp.StatusCommandNotImplemented {
+		return &textproto.Error{Code: code, Msg: message}
+	}
+	return sendType(c, "I")
+}
+
+// setDataProtection sends PBSZ and PROT to choose whether the data
+// connections are encrypted
+func setDataProtection(c *ftp.ServerConn, level string) error {
+	code, message, err := c.Quote("PBSZ 0")
+	if err != nil {
+		return err
+	}
+	if code != ftp.StatusCommandOK {
+		return &textproto.Error{Code: code, Msg: message}
+	}
+	return c.Prot(level)
+}
+
+// readFeatures reads the features the server supports with FEAT
+func readFeatures(c *ftp.ServerConn) (featureSet, error) {
+	code, message, err := c.Quote("FEAT")
+	if err != nil {
+		return nil, err
+	}
+	features := featureSet{}
+	if code != ftp.StatusSystem {
+		// FEAT not supported so assume no features
+		return features, nil
+	}
+	for _, line := range strings.Split(message, "\n") {
+		if !strings.HasPrefix(line, " ") {
+			continue
+		}
+		feature := strings.ToUpper(strings.TrimSpace(line))
+		features[feature] = struct{}{}
+		if i := strings.IndexByte(feature, ' '); i >= 0 {
+			features[feature[:i]] = struct{}{}
+		}
+	}
+	return features, nil
+}
+
+// readSystem reads the system type of the server with SYST, eg "UNIX
+// Type: L8", returning "" if the server doesn't support it
+func readSystem(c *ftp.ServerConn) (string, error) {
+	code, message, err := c.Quote("SYST")
+	if err != nil {
+		return "", err
+	}
+	if code != ftp.StatusName {
+		return "", nil
+	}
+	return strings.TrimSpace(message), nil
+}
+
+// systemListParser returns the list_parser to use for a server with
+// the system type from SYST if the format of its listings can't be
+// detected, or "" to detect it.  Windows servers aren't included as
+// they may list in the Unix style.
+func systemListParser(system string) string {
+	system = strings.ToUpper(system)
+	switch {
+	case strings.HasPrefix(system, "VMS"):
+		return "vms"
+	case strings.HasPrefix(system, "NETWARE"):
+		return "netware"
+	case strings.HasPrefix(system, "OS/400"):
+		return "os400"
+	}
+	return ""
+}
+
+// readPassword returns the password for the remote called name.
+//
+// This is read from the environment variable named by pass_env or is
+// the output of pass_command if either is set, otherwise it is the
+// obscured pass from the config.
+func readPassword(name string) (string, error) {
+	passEnv := config.FileGet(name, "pass_env")
+	passCommand := config.FileGet(name, "pass_command")
+	switch {
+	case passEnv != "" && passCommand != "":
+		return "", errors.New("only one of pass_env and pass_command can be set")
+	case passEnv != "":
+		pass, ok := os.LookupEnv(passEnv)
+		if !ok {
+			return "", errors.Errorf("pass_env: environment variable %q isn't set", passEnv)
+		}
+		return pass, nil
+	case passCommand != "":
+		return runPassCommand(passCommand)
+	}
+	pass, err := obscure.Reveal(config.FileGet(name, "pass"))
+	if err != nil {
+		return "", errors.Wrap(err, "decrypt password")
+	}
+	return pass, nil
+}
+
+// runPassCommand runs command, split into words on spaces, and
+// returns its output without the trailing line ending as the
+// password.  Its stderr goes to rclone's so it can prompt.
+func runPassCommand(command string) (string, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", errors.New("pass_command is empty")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "pass_command %q failed", command)
+	}
+	pass := strings.TrimRight(string(out), "\r\n")
+	if pass == "" {
+		return "", errors.Errorf("pass_command %q returned an empty password", command)
+	}
+	return pass, nil
+}
+
+// parseEncoding looks up the character set called name returning
+// nil if it is UTF-8 so no conversion is needed
+func parseEncoding(name string) (encoding.Encoding, error) {
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, errors.Errorf("bad encoding %q - must be a character set such as windows-1252", name)
+	}
+	if enc == unicode.UTF8 {
+		return nil, nil
+	}
+	return enc, nil
+}
+
+// parseDataPortRange parses a port range given as min-max
+func parseDataPortRange(portRange string) (min, max int, err error) {
+	parts := strings.SplitN(portRange, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, errors.Errorf("bad data_port_range %q - must be min-max", portRange)
+	}
+	min, err = strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err == nil {
+		max, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+	}
+	if err != nil || min < 1 || max > 65535 || min > max {
+		return 0, 0, errors.Errorf("bad data_port_range %q - must be min-max with 1 <= min <= max <= 65535", portRange)
+	}
+	return min, max, nil
+}
+
+// parseSocksProxy parses a SOCKS5 proxy given as [user:pass@]host:port
+func parseSocksProxy(socksProxy string) (addr string, auth *proxy.Auth, err error) {
+	addr = socksProxy
+	if i := strings.LastIndex(socksProxy, "@"); i >= 0 {
+		addr = socksProxy[i+1:]
+		userPass := strings.SplitN(socksProxy[:i], ":", 2)
+		auth = &proxy.Auth{User: userPass[0]}
+		if len(userPass) > 1 {
+			auth.Password = userPass[1]
+		}
+	}
+	if _, _, err = net.SplitHostPort(addr); err != nil {
+		return "", nil, errors.Wrapf(err, "bad SOCKS5 proxy %q", socksProxy)
+	}
+	return addr, auth, nil
+}
+
+// getToken waits for a free connection slot if the number of
+// connections is limited, returning ctx.Err() if ctx is done first
+func (f *Fs) getToken(ctx context.Context) error {
+	return acquire(ctx, f.tokens)
+}
+
+// putToken frees the connection slot taken by getToken
+func (f *Fs) putToken() {
+	release(f.tokens)
+}
+
+// acquire waits for a free slot in the semaphore slots, returning
+// ctx.Err() if ctx is done first.  A nil semaphore is unlimited.
+func acquire(ctx context.Context, slots chan struct{}) error {
+	if slots == nil {
+		return nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees a slot taken with acquire
+func release(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// tryAcquire takes a free slot in the semaphore slots without
+// waiting, returning false if there are none
+func tryAcquire(slots chan struct{}) bool {
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
 // Get an FTP connection from the pool, or open a new one
-func (f *Fs) getFtpConnection() (c *ftp.ServerConn, err error) {
+//
+// If the number of connections is limited this waits for one to be
+// returned unless ctx is done first.
+func (f *Fs) getFtpConnection(ctx context.Context) (c *ftp.ServerConn, err error) {
+	err = f.getToken(ctx)
+	if err != nil {
+		return nil, err
+	}
 	f.poolMu.Lock()
 	if len(f.pool) > 0 {
 		c = f.pool[0]
 		f.pool = f.pool[1:]
+		f.stats.Reused++
+		f.stats.InUse++
 	}
 	f.poolMu.Unlock()
 	if c != nil {
 		return c, nil
 	}
-	return f.ftpConnection()
-}
-
-// Return an FTP connection to the pool
-//
-// It nils the pointed to connection out so it can't be reused
-//
-// if err is not nil then it checks the connection is alive using a
-// NOOP request
-func (f *Fs) putFtpConnection(pc **ftp.ServerConn, err error) {
-	c := *pc
-	*pc = nil
-	if err != nil {
-		// If not a regular FTP error code then check the connection
-		_, isRegularError := errors.Cause(err).(*textproto.Error)
-		if !isRegularError {
-			nopErr := c.NoOp()
-			if nopErr != nil {
-				fs.Debugf(f, "Connection failed, closing: %v", nopErr)
-				_ = c.Quit()
-				return
-			}
+	err = f.getHostSlot(ctx)
+	if err != nil {
+		f.putToken()
+		return nil, err
+	}
+	c, err = f.connect(ctx)
+	if err != nil {
+		f.putHostSlot()
+		f.putToken()
+		return nil, err
+	}
+	f.poolMu.Lock()
+	f.stats.InUse++
+	f.poolMu.Unlock()
+	return c, nil
+}
+
+// getState returns the changed state of c, creating it if necessary
+func (f *Fs) getState(c *ftp.ServerConn) *connState {
+	f.poolMu.Lock()
+	defer f.poolMu.Unlock()
+	state := f.state[c]
+	if state == nil {
+		if f.state == nil {
+			f.state = make(map[*ftp.ServerConn]*connState)
+		}
+		state = &connState{}
+		f.state[c] = state
+	}
+	return state
+}
+
+// changeDir changes the working directory of c remembering the
+// original so it can be restored before c is reused
+func (f *Fs) changeDir(c *ftp.ServerConn, dir string) error {
+	state := f.getState(c)
+	if state.dir == "" {
+		cwd, err := c.CurrentDir()
+		if err != nil {
+			return err
+		}
+		state.dir = cwd
+	}
+	return c.ChangeDir(dir)
+}
+
+// setType sets the transfer type of c, eg "A" for ASCII.  c will be
+// put back into binary mode before it is reused.
+func (f *Fs) setType(c *ftp.ServerConn, transferType string) error {
+	f.getState(c).typeChanged = true
+	return sendType(c, transferType)
+}
+
+// sendType sends TYPE to set the transfer type of c
+func sendType(c *ftp.ServerConn, transferType string) error {
+	code, message, err := c.Quote("TYPE %s", transferType)
+	if err == nil && code != ftp.StatusCommandOK {
+		err = &textproto.Error{Code: code, Msg: message}
+	}
+	return err
+}
+
+// setTransferType puts c into ASCII mode for a transfer if the ascii
+// option is set.  Connections are in binary mode otherwise.
+func (f *Fs) setTransferType(c *ftp.ServerConn) error {
+	if !f.ascii {
+		return nil
+	}
+	return f.setType(c, "A")
+}
+
+// DataProtectionOption is an fs.OpenOption for Open and Update which
+// sets the PROT level of the data connection for that transfer only
+// when using FTPS.  Level "C" sends the data in the clear which is
+// faster but can be read or changed by anyone on the network, "P"
+// encrypts it.  The control connection stays encrypted either way.
+type DataProtectionOption struct {
+	Level string
+}
+
+// Header formats the option as an http header - it has none
+func (o *DataProtectionOption) Header() (key string, value string) {
+	return "", ""
+}
+
+// String formats the option into human readable form
+func (o *DataProtectionOption) String() string {
+	return fmt.Sprintf("DataProtectionOption(%q)", o.Level)
+}
+
+// Mandatory returns whether the option must be parsed or can be ignored
+func (o *DataProtectionOption) Mandatory() bool {
+	return false
+}
+
+// check interface
+var _ fs.OpenOption = (*DataProtectionOption)(nil)
+
+// transferProtection returns the PROT level to use for a transfer
+// with options, which is data_protection unless there is a
+// DataProtectionOption
+func (f *Fs) transferProtection(options []fs.OpenOption) (string, error) {
+	level := f.dataProtection
+	for _, option := range options {
+		if x, ok := option.(*DataProtectionOption); ok {
+			level = strings.ToUpper(x.Level)
+		}
+	}
+	if level != "P" && level != "C" {
+		return "", errors.Errorf("bad data protection level %q - must be P or C", level)
+	}
+	return level, nil
+}
+
+// setTransferProtection sets the PROT level of c for a transfer if it
+// differs from data_protection.  c will be put back to the default
+// level before it is reused.  Without TLS it does nothing.
+func (f *Fs) setTransferProtection(c *ftp.ServerConn, level string) error {
+	if f.tlsConfig == nil || level == f.dataProtection {
+		return nil
+	}
+	f.getState(c).protChanged = true
+	return setDataProtection(c, level)
+}
+
+// resetConnection restores any state of c changed with changeDir,
+// setType or setTransferProtection so it is the same as a freshly made connection
+func (f *Fs) resetConnection(c *ftp.ServerConn) error {
+	f.poolMu.Lock()
+	state := f.state[c]
+	delete(f.state, c)
+	f.poolMu.Unlock()
+	if state == nil {
+		return nil
+	}
+	if f.noReset {
+		return errors.New("connection state changed and disable_connection_reset is set")
+	}
+	if state.typeChanged {
+		if err := sendType(c, "I"); err != nil {
+			return err
+		}
+	}
+	if state.protChanged {
+		if err := setDataProtection(c, f.dataProtection); err != nil {
+			return err
+		}
+	}
+	if state.dir != "" {
+		return c.ChangeDir(state.dir)
+	}
+	return nil
+}
+
+// Return an FTP connection to the pool
+//
+// It nils the pointed to connection out so it can't be reused
+//
+// if err is not nil then it checks the connection is alive using a
+// NOOP request
+//
+// If err is a 530 reply the server has logged the connection out, so
+// it is logged in again with REIN and closed if that fails.  It
+// returns true if the connection was logged in again as the command
+// wasn't run and can be retried.  If a command timed out the
+// connection is closed.
+//
+// Any state changed on the connection is reset first and if that
+// fails the connection is closed.
+//
+// If no_pool is set the connection is always closed.
+func (f *Fs) putFtpConnection(pc **ftp.ServerConn, err error) (relogged bool) {
+	c := *pc
+	*pc = nil
+	defer f.putToken()
+	f.poolMu.Lock()
+	f.stats.InUse--
+	if f.noPool {
+		delete(f.state, c)
+	}
+	f.poolMu.Unlock()
+	if f.noPool {
+		_ = c.Quit()
+		f.putHostSlot()
+		return
+	}
+	if isTimeout(err) {
+		// The reply may still arrive and be mistaken for the
+		// reply to the next command so don't reset or reuse it
+		fs.Debugf(f, "Command timed out, closing: %v", err)
+		f.discard(c)
+		return
+	}
+	if isNotLoggedIn(err) {
+		// The server has logged the connection out so log in
+		// again rather than dialing a new one
+		if loginErr := f.relogin(c); loginErr != nil {
+			fs.Debugf(f, "Couldn't log connection in again, closing: %v", loginErr)
+			f.discard(c)
+			return
+		}
+		fs.Debugf(f, "Logged connection in again after: %v", err)
+		err = nil
+		relogged = true
+	}
+	if resetErr := f.resetConnection(c); resetErr != nil {
+		fs.Debugf(f, "Couldn't reset connection, closing: %v", resetErr)
+		f.discard(c)
+		return
+	}
+	if err != nil {
+		if isNotAvailable(err) {
+			// The server is closing the connection
+			fs.Debugf(f, "Connection not available, closing: %v", err)
+			f.discard(c)
+			return
+		}
+		// If not a regular FTP error code then check the connection
+		_, isRegularError := errors.Cause(err).(*textproto.Error)
+		if _, notSent := errors.Cause(err).(*ftp.InvalidCommandError); notSent {
+			isRegularError = true
+		}
+		if !isRegularError {
+			nopErr := c.NoOp()
+			if nopErr != nil {
+				fs.Debugf(f, "Connection failed, closing: %v", nopErr)
+				f.discard(c)
+				// the pooled connections are likely dead too
+				f.purgePool()
+				return
+			}
+		}
+	}
+	f.poolMu.Lock()
+	f.pool = append(f.pool, c)
+	if f.drain != nil {
+		f.drain.Reset(f.idleTimeout) // nudge on the pool emptying timer
+	}
+	f.poolMu.Unlock()
+	return relogged
+}
+
+// purgePool checks all the connections in the pool with NOOP and
+// closes any which have failed.
+//
+// This is called when a connection is found to be dead as the others
+// probably are too, eg after a network outage, and otherwise each
+// would only be discovered by a failing operation.
+//
+// The connections are taken out of the pool to check one at a time.
+// The caller must hold a token which isn't used by a connection to
+// account for the one being checked, otherwise more than pool_max
+// connections could be opened while it is out.
+func (f *Fs) purgePool() {
+	f.poolMu.Lock()
+	n := len(f.pool)
+	f.poolMu.Unlock()
+	for i := 0; i < n; i++ {
+		f.poolMu.Lock()
+		if len(f.pool) == 0 {
+			f.poolMu.Unlock()
+			return
+		}
+		c := f.pool[0]
+		f.pool = f.pool[1:]
+		f.poolMu.Unlock()
+		if err := c.NoOp(); err != nil {
+			fs.Debugf(f, "Closing dead connection from pool: %v", err)
+			f.discard(c)
+			continue
+		}
+		f.poolMu.Lock()
+		f.pool = append(f.pool, c)
+		f.poolMu.Unlock()
+	}
+}
+
+// closeFtpConnection closes a connection got with getFtpConnection
+// instead of returning it to the pool.
+//
+// It nils the pointed to connection out so it can't be reused
+func (f *Fs) closeFtpConnection(pc **ftp.ServerConn) {
+	c := *pc
+	*pc = nil
+	f.poolMu.Lock()
+	delete(f.state, c)
+	f.stats.InUse--
+	f.poolMu.Unlock()
+	f.discard(c)
+	f.putToken()
+}
+
+// discard closes c counting it in the connection stats
+func (f *Fs) discard(c *ftp.ServerConn) {
+	_ = c.Quit()
+	f.putHostSlot()
+	f.poolMu.Lock()
+	f.stats.Discarded++
+	f.poolMu.Unlock()
+}
+
+// poolMaintainInterval is how often the pool is checked for dead
+// connections and topped up to pool_min
+var poolMaintainInterval = 30 * time.Second
+
+// startMaintainer starts keeping pool_min connections open in the
+// pool in the background if it is set and this isn't being done
+// already.  It is stopped by drainPool.
+func (f *Fs) startMaintainer() {
+	if f.poolMin <= 0 {
+		return
+	}
+	f.poolMu.Lock()
+	defer f.poolMu.Unlock()
+	if f.stop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	f.stop = stop
+	go func() {
+		ticker := time.NewTicker(poolMaintainInterval)
+		defer ticker.Stop()
+		for {
+			f.maintainPool(stop)
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// maintainPool closes the dead connections in the pool then dials
+// new ones until pool_min are open.
+//
+// A connection is only dialed if a token and a slot for the server
+// are free straight away so it never waits for or takes connections
+// from operations.
+func (f *Fs) maintainPool(stop chan struct{}) {
+	if tryAcquire(f.tokens) {
+		f.purgePool()
+		f.putToken()
+	}
+	for {
+		f.poolMu.Lock()
+		open := f.stats.InUse + len(f.pool)
+		stopped := f.stop != stop
+		f.poolMu.Unlock()
+		if stopped || open >= f.poolMin || !tryAcquire(f.tokens) {
+			return
+		}
+		if !f.tryHostSlot() {
+			f.putToken()
+			return
+		}
+		c, err := f.connect(context.Background())
+		if err != nil {
+			f.putHostSlot()
+			f.putToken()
+			fs.Debugf(f, "Couldn't open connection to keep in the pool: %v", err)
+			return
+		}
+		f.poolMu.Lock()
+		stopped = f.stop != stop
+		if !stopped {
+			f.pool = append(f.pool, c)
+		}
+		f.poolMu.Unlock()
+		f.putToken()
+		if stopped {
+			// drainPool has been called so don't leave it open
+			_ = c.Quit()
+			f.putHostSlot()
+			return
+		}
+	}
+}
+
+// expirePool is called when the pool has been idle for idle_timeout.
+// It closes the connections in it apart from those needed to keep
+// pool_min open.
+func (f *Fs) expirePool() {
+	if f.poolMin <= 0 {
+		_ = f.drainPool()
+		return
+	}
+	f.poolMu.Lock()
+	var expired []*ftp.ServerConn
+	keep := f.poolMin - f.stats.InUse
+	if keep < 0 {
+		keep = 0
+	}
+	if len(f.pool) > keep {
+		expired = f.pool[keep:]
+		f.pool = f.pool[:keep:keep]
+	}
+	f.poolMu.Unlock()
+	if len(expired) != 0 {
+		fs.Debugf(f, "closing %d unused connections above pool_min", len(expired))
+	}
+	for _, c := range expired {
+		_ = c.Quit()
+		f.putHostSlot()
+	}
+}
+
+// drainPool closes all the connections in the pool and stops the
+// pool_min maintainer, logging the connection stats first
+func (f *Fs) drainPool() (err error) {
+	f.poolMu.Lock()
+	defer f.poolMu.Unlock()
+	if f.drain != nil {
+		f.drain.Stop()
+	}
+	if f.stop != nil {
+		close(f.stop)
+		f.stop = nil
+	}
+	if len(f.pool) != 0 {
+		fs.Debugf(f, "closing %d unused connections", len(f.pool))
+	}
+	if f.stats.Opened != 0 {
+		stats := f.stats
+		stats.Pooled = len(f.pool)
+		fs.Debugf(f, "Connections: %v", stats)
+	}
+	for i, c := range f.pool {
+		if cErr := c.Quit(); cErr != nil {
+			err = cErr
+		}
+		f.putHostSlot()
+		f.pool[i] = nil
+	}
+	f.pool = nil
+	return err
+}
+
+// NewFs contstructs an Fs from the path, container:path
+func NewFs(name, root string) (ff fs.Fs, err error) {
+	// defer fs.Trace(nil, "name=%q, root=%q", name, root)("fs=%v, err=%v", &ff, &err)
+	// FIXME Convert the old scheme used for the first beta - remove after release
+	if ftpURL := config.FileGet(name, "url"); ftpURL != "" {
+		fs.Infof(name, "Converting old configuration")
+		u, err := url.Parse(ftpURL)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to parse old url %q", ftpURL)
+		}
+		config.FileSet(name, "host", u.Hostname())
+		if port := u.Port(); port != "" {
+			config.FileSet(name, "port", port)
+		}
+		config.FileSet(name, "user", config.FileGet(name, "username"))
+		config.FileSet(name, "pass", config.FileGet(name, "password"))
+		config.FileDeleteKey(name, "username")
+		config.FileDeleteKey(name, "password")
+		config.FileDeleteKey(name, "url")
+		config.SaveConfig()
+		if u.Path != "" && u.Path != "/" {
+			fs.Errorf(name, "Path %q in FTP URL no longer supported - put it on the end of the remote %s:%s", u.Path, name, u.Path)
+		}
+	}
+	host := config.FileGet(name, "host")
+	user := config.FileGet(name, "user")
+	port := config.FileGet(name, "port")
+	pass, err := readPassword(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "NewFS")
+	}
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	loginSteps, err := parseLoginMode(config.FileGet(name, "login_mode"), config.FileGet(name, "account"))
+	if err != nil {
+		return nil, errors.Wrap(err, "NewFs")
+	}
+	useTLS := config.FileGetBool(name, "tls")
+	explicitTLS := config.FileGetBool(name, "explicit_tls")
+	if useTLS && explicitTLS {
+		return nil, errors.New("NewFs: tls and explicit_tls can't both be set")
+	}
+	host, port, err = hostPort(host, port, useTLS)
+	if err != nil {
+		return nil, errors.Wrap(err, "NewFs")
+	}
+	if config.FileGet(name, "client_cert") != "" && !useTLS && !explicitTLS {
+		return nil, errors.New("NewFs: client_cert needs tls or explicit_tls")
+	}
+	var tlsConfig *tls.Config
+	if useTLS || explicitTLS {
+		serverName := config.FileGet(name, "tls_server_name")
+		if serverName == "" {
+			serverName = host
+		}
+		minVersion, err := parseTLSVersion(config.FileGet(name, "tls_min_version"))
+		if err != nil {
+			return nil, errors.Wrap(err, "NewFs: bad tls_min_version")
+		}
+		maxVersion, err := parseTLSVersion(config.FileGet(name, "tls_max_version"))
+		if err != nil {
+			return nil, errors.Wrap(err, "NewFs: bad tls_max_version")
+		}
+		if minVersion != 0 && maxVersion != 0 && minVersion > maxVersion {
+			return nil, errors.New("NewFs: tls_min_version is greater than tls_max_version")
+		}
+		rootCAs, err := loadCACerts(config.FileGet(name, "ca_cert"))
+		if err != nil {
+			return nil, errors.Wrap(err, "NewFs: bad ca_cert")
+		}
+		clientCerts, err := loadClientCert(config.FileGet(name, "client_cert"))
+		if err != nil {
+			return nil, errors.Wrap(err, "NewFs: bad client_cert")
+		}
+		tlsConfig = &tls.Config{
+			Certificates:       clientCerts,
+			RootCAs:            rootCAs,
+			ServerName:         serverName,
+			MinVersion:         minVersion,
+			MaxVersion:         maxVersion,
+			InsecureSkipVerify: config.FileGetBool(name, "no_check_certificate"),
+			// Shared by the control and data connections so the
+			// data connections resume the control connection's TLS
+			// session which some servers require.
+			ClientSessionCache: tls.NewLRUClientSessionCache(32),
+		}
+	}
+	dataProtection := "P"
+	switch tlsDataProtection := config.FileGet(name, "tls_data_protection"); tlsDataProtection {
+	case "", "private":
+	case "clear":
+		dataProtection = "C"
+	default:
+		return nil, errors.Errorf("NewFs: bad tls_data_protection %q - must be private or clear", tlsDataProtection)
+	}
+	connectTimeout := fs.Config.ConnectTimeout
+	if connectTimeoutString := config.FileGet(name, "connect_timeout"); connectTimeoutString != "" {
+		connectTimeout, err = fs.ParseDuration(connectTimeoutString)
+		if err != nil {
+			return nil, errors.Wrapf(err, "NewFs: bad connect_timeout %q", connectTimeoutString)
+		}
+	}
+	bindAddress := fs.Config.BindAddr
+	if bindAddressString := config.FileGet(name, "bind_address"); bindAddressString != "" {
+		bindAddress = net.ParseIP(bindAddressString)
+		if bindAddress == nil {
+			return nil, errors.Errorf("NewFs: bad bind_address %q - must be an IP address", bindAddressString)
+		}
+	}
+	dialNetwork, err := parseDialNetwork(config.FileGet(name, "dial_network"))
+	if err != nil {
+		return nil, errors.Wrap(err, "NewFs")
+	}
+	var socksAuth *proxy.Auth
+	socksProxy := config.FileGet(name, "socks_proxy")
+	if socksProxy != "" {
+		socksProxy, socksAuth, err = parseSocksProxy(socksProxy)
+		if err != nil {
+			return nil, errors.Wrap(err, "NewFs")
+		}
+	}
+	activeMode := config.FileGetBool(name, "active_mode")
+	if activeMode && socksProxy != "" {
+		return nil, errors.New("NewFs: active_mode can't be used with socks_proxy")
+	}
+	var dataPortMin, dataPortMax int
+	if dataPortRange := config.FileGet(name, "data_port_range"); dataPortRange != "" {
+		dataPortMin, dataPortMax, err = parseDataPortRange(dataPortRange)
+		if err != nil {
+			return nil, errors.Wrap(err, "NewFs")
+		}
+	}
+	retries := defaultRetries
+	if retriesString := config.FileGet(name, "retries"); retriesString != "" {
+		retries, err = strconv.Atoi(retriesString)
+		if err != nil || retries < 1 {
+			return nil, errors.Errorf("NewFs: bad retries %q - must be a number >= 1", retriesString)
+		}
+	}
+	noReset := config.FileGetBool(name, "disable_connection_reset")
+	connectRetries := defaultConnectRetries
+	if connectRetriesString := config.FileGet(name, "connect_retries"); connectRetriesString != "" {
+		connectRetries, err = strconv.Atoi(connectRetriesString)
+		if err != nil || connectRetries < 0 {
+			return nil, errors.Errorf("NewFs: bad connect_retries %q - must be a number >= 0", connectRetriesString)
+		}
+	}
+	concurrency := 0
+	if concurrencyString := config.FileGet(name, "concurrency"); concurrencyString != "" {
+		concurrency, err = strconv.Atoi(concurrencyString)
+		if err != nil || concurrency < 0 {
+			return nil, errors.Errorf("NewFs: bad concurrency %q - must be a number >= 0", concurrencyString)
+		}
+	}
+	maxListDepth := 0
+	if maxListDepthString := config.FileGet(name, "max_list_depth"); maxListDepthString != "" {
+		maxListDepth, err = strconv.Atoi(maxListDepthString)
+		if err != nil || maxListDepth < 0 {
+			return nil, errors.Errorf("NewFs: bad max_list_depth %q - must be a number >= 0", maxListDepthString)
+		}
+	}
+	maxPerHost := 0
+	if maxPerHostString := config.FileGet(name, "max_connections_per_host"); maxPerHostString != "" {
+		maxPerHost, err = strconv.Atoi(maxPerHostString)
+		if err != nil || maxPerHost < 0 {
+			return nil, errors.Errorf("NewFs: bad max_connections_per_host %q - must be a number >= 0", maxPerHostString)
+		}
+	}
+	poolMin := 0
+	if poolMinString := config.FileGet(name, "pool_min"); poolMinString != "" {
+		poolMin, err = strconv.Atoi(poolMinString)
+		if err != nil || poolMin < 0 {
+			return nil, errors.Errorf("NewFs: bad pool_min %q - must be a number >= 0", poolMinString)
+		}
+	}
+	poolMax := 0
+	if poolMaxString := config.FileGet(name, "pool_max"); poolMaxString != "" {
+		poolMax, err = strconv.Atoi(poolMaxString)
+		if err != nil || poolMax < 0 {
+			return nil, errors.Errorf("NewFs: bad pool_max %q - must be a number >= 0", poolMaxString)
+		}
+	}
+	for _, limit := range []struct {
+		name  string
+		value int
+	}{
+		{"pool_max", poolMax},
+		{"concurrency", concurrency},
+		{"max_connections_per_host", maxPerHost},
+	} {
+		if poolMin > 0 && limit.value > 0 && poolMin > limit.value {
+			return nil, errors.Errorf("NewFs: pool_min %d can't be more than %s %d", poolMin, limit.name, limit.value)
+		}
+	}
+	if poolMin > 0 && config.FileGetBool(name, "no_pool") {
+		return nil, errors.New("NewFs: can't use pool_min with no_pool")
+	}
+	chmod := config.FileGet(name, "chmod")
+	if chmod != "" {
+		if _, err := strconv.ParseUint(chmod, 8, 32); err != nil {
+			return nil, errors.Errorf("NewFs: bad chmod %q - must be an octal mode", chmod)
+		}
+	}
+	timezone, err := parseTimezone(config.FileGet(name, "timezone"))
+	if err != nil {
+		return nil, errors.Wrap(err, "NewFs")
+	}
+	listParser, err := parseListParser(config.FileGet(name, "list_parser"))
+	if err != nil {
+		return nil, errors.Wrap(err, "NewFs")
+	}
+	trailingSlash, err := parseTrailingSlash(config.FileGet(name, "trailing_slash"))
+	if err != nil {
+		return nil, errors.Wrap(err, "NewFs")
+	}
+	var asciiCRLF bool
+	switch lineEnding := strings.ToLower(config.FileGet(name, "ascii_line_ending")); lineEnding {
+	case "", "lf":
+	case "crlf":
+		asciiCRLF = true
+	default:
+		return nil, errors.Errorf("NewFs: bad ascii_line_ending %q - must be lf or crlf", lineEnding)
+	}
+	umask := config.FileGet(name, "umask")
+	if umask != "" {
+		if _, err := strconv.ParseUint(umask, 8, 32); err != nil {
+			return nil, errors.Errorf("NewFs: bad umask %q - must be an octal mask", umask)
+		}
+	}
+	idleTimeout := fs.Config.Timeout
+	if idleTimeoutString := config.FileGet(name, "idle_timeout"); idleTimeoutString != "" {
+		idleTimeout, err = fs.ParseDuration(idleTimeoutString)
+		if err != nil {
+			return nil, errors.Wrapf(err, "NewFs: bad idle_timeout %q", idleTimeoutString)
+		}
+	}
+	dataTimeout := fs.Config.Timeout
+	if dataTimeoutString := config.FileGet(name, "data_timeout"); dataTimeoutString != "" {
+		dataTimeout, err = fs.ParseDuration(dataTimeoutString)
+		if err != nil {
+			return nil, errors.Wrapf(err, "NewFs: bad data_timeout %q", dataTimeoutString)
+		}
+	}
+	var commandTimeout time.Duration
+	if commandTimeoutString := config.FileGet(name, "command_timeout"); commandTimeoutString != "" {
+		commandTimeout, err = fs.ParseDuration(commandTimeoutString)
+		if err != nil {
+			return nil, errors.Wrapf(err, "NewFs: bad command_timeout %q", commandTimeoutString)
+		}
+	}
+	// net.Dialer uses the system default for 0 and turns
+	// keep-alives off if negative
+	var keepAlive time.Duration
+	if keepAliveString := config.FileGet(name, "tcp_keepalive"); keepAliveString != "" {
+		keepAlive, err = fs.ParseDuration(keepAliveString)
+		if err != nil {
+			return nil, errors.Wrapf(err, "NewFs: bad tcp_keepalive %q", keepAliveString)
+		}
+		if keepAlive == 0 {
+			keepAlive = -1
 		}
 	}
-	f.poolMu.Lock()
-	f.pool = append(f.pool, c)
-	f.poolMu.Unlock()
-}
-
-// NewFs contstructs an Fs from the path, container:path
-func NewFs(name, root string) (ff fs.Fs, err error) {
-	// defer fs.Trace(nil, "name=%q, root=%q", name, root)("fs=%v, err=%v", &ff, &err)
-	// FIXME Convert the old scheme used for the first beta - remove after release
-	if ftpURL := config.FileGet(name, "url"); ftpURL != "" {
-		fs.Infof(name, "Converting old configuration")
-		u, err := url.Parse(ftpURL)
+	var bwLimit *rate.Limiter
+	if bwLimitString := config.FileGet(name, "bandwidth_limit"); bwLimitString != "" {
+		var bandwidth fs.SizeSuffix
+		err = bandwidth.Set(bwLimitString)
 		if err != nil {
-			return nil, errors.Wrapf(err, "Failed to parse old url %q", ftpURL)
+			return nil, errors.Wrapf(err, "NewFs: bad bandwidth_limit %q", bwLimitString)
 		}
-		parts := strings.Split(u.Host, ":")
-		config.FileSet(name, "host", parts[0])
-		if len(parts) > 1 {
-			config.FileSet(name, "port", parts[1])
+		if bandwidth > 0 {
+			bwLimit = newBwLimiter(bandwidth)
 		}
-		config.FileSet(name, "host", u.Host)
-		config.FileSet(name, "user", config.FileGet(name, "username"))
-		config.FileSet(name, "pass", config.FileGet(name, "password"))
-		config.FileDeleteKey(name, "username")
-		config.FileDeleteKey(name, "password")
-		config.FileDeleteKey(name, "url")
-		config.SaveConfig()
-		if u.Path != "" && u.Path != "/" {
-			fs.Errorf(name, "Path %q in FTP URL no longer supported - put it on the end of the remote %s:%s", u.Path, name, u.Path)
+	}
+	var chunkUpload fs.SizeSuffix
+	if chunkString := config.FileGet(name, "chunk_upload"); chunkString != "" {
+		err = chunkUpload.Set(chunkString)
+		if err != nil || chunkUpload < 0 {
+			return nil, errors.Errorf("NewFs: bad chunk_upload %q", chunkString)
 		}
 	}
-	host := config.FileGet(name, "host")
-	user := config.FileGet(name, "user")
-	pass := config.FileGet(name, "pass")
-	port := config.FileGet(name, "port")
-	pass, err = obscure.Reveal(pass)
-	if err != nil {
-		return nil, errors.Wrap(err, "NewFS decrypt password")
+
+	var nameEncoding encoding.Encoding
+	if encodingName := config.FileGet(name, "encoding"); encodingName != "" {
+		nameEncoding, err = parseEncoding(encodingName)
+		if err != nil {
+			return nil, errors.Wrap(err, "NewFs")
+		}
 	}
-	if user == "" {
-		user = os.Getenv("USER")
+	prefix := config.FileGet(name, "path_prefix")
+	rootIsRelative := config.FileGetBool(name, "root_is_relative")
+	if prefix != "" && rootIsRelative {
+		return nil, errors.New("NewFs: path_prefix can't be used with root_is_relative")
 	}
-	if port == "" {
-		port = "21"
+	tempPattern := config.FileGet(name, "cleanup_pattern", defaultTempPattern)
+	if _, err := path.Match(tempPattern, ""); err != nil {
+		return nil, errors.Errorf("NewFs: bad cleanup_pattern %q", tempPattern)
+	}
+	readOnly := config.FileGetBool(name, "read_only")
+	if readOnly && config.FileGetBool(name, "create_root") {
+		return nil, errors.New("NewFs: create_root can't be used with read_only")
 	}
 
-	dialAddr := host + ":" + port
-	u := "ftp://" + path.Join(dialAddr+"/", root)
+	dialAddr := net.JoinHostPort(host, port)
+	u := "ftp://" + path.Join(dialAddr+"/", prefix, root)
 	f := &Fs{
 		name:     name,
 		root:     root,
+		prefix:   prefix,
 		url:      u,
 		user:     user,
 		pass:     pass,
+		account:  config.FileGet(name, "account"),
 		dialAddr: dialAddr,
+		pacer:    pacer.New().SetMinSleep(minSleep).SetMaxSleep(maxSleep).SetDecayConstant(decayConstant).SetRetries(retries),
+
+		loginSteps:     loginSteps,
+		connectTimeout: connectTimeout,
+		idleTimeout:    idleTimeout,
+		dataTimeout:    dataTimeout,
+		commandTimeout: commandTimeout,
+		tolerantClose:  config.FileGetBool(name, "tolerant_close"),
+		keepAlive:      keepAlive,
+		bwLimit:        bwLimit,
+		bindAddress:    bindAddress,
+		dialNetwork:    dialNetwork,
+		socksProxy:     socksProxy,
+		socksAuth:      socksAuth,
+		forceControlIP: config.FileGetBool(name, "force_control_ip"),
+		activeMode:     activeMode,
+		dataPortMin:    dataPortMin,
+		dataPortMax:    dataPortMax,
+		noReset:        noReset,
+		noPool:         config.FileGetBool(name, "no_pool"),
+		retries:        retries,
+		connectRetries: connectRetries,
+		concurrency:    concurrency,
+		maxPerHost:     maxPerHost,
+		poolMin:        poolMin,
+		poolMax:        poolMax,
+		followSymlinks: config.FileGetBool(name, "follow_symlinks"),
+		listParser:     listParser,
+		trailingSlash:  trailingSlash,
+		disableMLSD:    config.FileGetBool(name, "disable_mlsd"),
+		maxListDepth:   maxListDepth,
+		showHidden:     config.FileGetBool(name, "show_hidden"),
+		ignoreCase:     config.FileGetBool(name, "case_insensitive"),
+		timezone:       timezone,
+		ascii:          config.FileGetBool(name, "ascii"),
+		asciiCRLF:      asciiCRLF,
+		chmod:          chmod,
+		umask:          umask,
+		atomicUpload:   config.FileGetBool(name, "atomic_upload"),
+		verifyUpload:   config.FileGetBool(name, "verify_upload"),
+		chunkUpload:    chunkUpload,
+		readOnly:       readOnly,
+		tempPattern:    tempPattern,
+		tlsConfig:      tlsConfig,
+		explicitTLS:    explicitTLS,
+		dataProtection: dataProtection,
+		encoding:       nameEncoding,
 	}
 	f.features = (&fs.Features{
+		CaseInsensitive:         f.ignoreCase,
+		DuplicateFiles:          false,
+		ReadMimeType:            false, // FTP has no MIME types
+		WriteMimeType:           false,
 		CanHaveEmptyDirectories: true,
+		BucketBased:             false,
 	}).Fill(f)
+	f.dial = f.dialDirect
+	if config.FileGetBool(name, "use_cwd_listing") {
+		f.cwdListing = 1
+	}
+	createRoot := config.FileGetBool(name, "create_root")
+	if rootIsRelative && root != "" {
+		f.cwd, f.root = root, ""
+	}
+	f.useConnPool()
+	defer func() {
+		// don't leave connections open for an Fs which won't
+		// be used
+		if err != nil && err != fs.ErrorIsFile {
+			f.releaseConnPool()
+		}
+	}()
+	if f.cwd != "" && createRoot {
+		err = f.mkdirRelativeRoot()
+		if err != nil {
+			return nil, errors.Wrap(err, "NewFs create_root")
+		}
+	}
 	// Make a connection and pool it to return errors early
-	c, err := f.getFtpConnection()
+	c, err := f.getFtpConnection(context.Background())
 	if err != nil {
+		if f.cwd != "" && translateErrorDir(errors.Cause(err)) == fs.ErrorDirNotFound {
+			return f.relativeRootNotFound(err)
+		}
 		return nil, errors.Wrap(err, "NewFs")
 	}
-	f.putFtpConnection(&c, nil)
-	if root != "" {
+	f.serverFeatures, err = readFeatures(c)
+	if err != nil {
+		f.putFtpConnection(&c, err)
+		return nil, errors.Wrap(err, "NewFs FEAT")
+	}
+	if f.disableMLSD {
+		f.serverFeatures.remove("MLST")
+		f.serverFeatures.remove("MLSD")
+	}
+	f.system, err = readSystem(c)
+	if err != nil {
+		f.putFtpConnection(&c, err)
+		return nil, errors.Wrap(err, "NewFs SYST")
+	}
+	fs.Debugf(f, "Server system type %q", f.system)
+	if f.listParser == "" {
+		f.listParser = systemListParser(f.system)
+	}
+	if f.listParser != "" && f.listParser != listParser {
+		// the connection was made to detect the format so
+		// don't reuse it
+		fs.Debugf(f, "Using list_parser %s for the server's system type", f.listParser)
+		f.closeFtpConnection(&c)
+	} else {
+		f.putFtpConnection(&c, nil)
+	}
+	f.startMaintainer()
+	if root != "" && f.cwd == "" {
 		// Check to see if the root actually an existing file
 		remote := path.Base(root)
 		f.root = path.Dir(root)
@@ -228,80 +2416,715 @@ func NewFs(name, root string) (ff fs.Fs, err error) {
 			f.root = ""
 		}
 		_, err := f.NewObject(remote)
+		if err == nil {
+			// return an error with an fs which points to the parent
+			return f, fs.ErrorIsFile
+		}
+		if err != fs.ErrorObjectNotFound && errors.Cause(err) != fs.ErrorNotAFile {
+			return nil, err
+		}
+		// File doesn't exist so return old f
+		f.root = root
+	}
+	if createRoot {
+		err = f.mkdir(context.Background(), f.fullPath(""))
+		if err != nil {
+			return nil, errors.Wrap(err, "NewFs create_root")
+		}
+	}
+	return f, nil
+}
+
+// mkdirRelativeRoot makes the root directory when root_is_relative
+// and create_root are set.  This must be done from the login
+// directory before any connection tries to change into the root.
+//
+// If the root is a file it does nothing so NewFs finds that out when
+// it can't change into it.
+func (f *Fs) mkdirRelativeRoot() error {
+	root, rootPool := f.cwd, f.connPool
+	// use the pool of connections which stay in the login directory
+	f.cwd = ""
+	f.useConnPool()
+	err := f.mkdir(context.Background(), root)
+	f.releaseConnPool()
+	f.cwd, f.connPool = root, rootPool
+	if err == fs.ErrorIsFile {
+		return nil
+	}
+	return err
+}
+
+// Default ports for plain FTP or explicit FTPS and for implicit FTPS
+const (
+	defaultPort    = "21"
+	defaultTLSPort = "990"
+)
+
+// hostPort returns the host to connect to and its port.  This is port
+// if set, otherwise the port on the end of host as host:port or
+// [host]:port if there is one, otherwise the default for the TLS mode.
+// implicitTLS should be set for the tls config option.
+func hostPort(host, port string, implicitTLS bool) (string, string, error) {
+	if name, hostPort, err := net.SplitHostPort(host); err == nil {
+		if port != "" && hostPort != "" && port != hostPort {
+			return "", "", errors.Errorf("port %q doesn't match the port in host %q", port, host)
+		}
+		host = name
+		if port == "" {
+			port = hostPort
+		}
+	} else {
+		// no port, or an IPv6 address without one
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	switch {
+	case port != "":
+	case implicitTLS:
+		port = defaultTLSPort
+	default:
+		port = defaultPort
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", "", errors.Errorf("bad port %q - must be a number from 1 to 65535", port)
+	}
+	return host, port, nil
+}
+
+// parseLoginMode parses the login_mode option into the commands to
+// log in with, returning nil for "" or user_pass to log in the usual
+// way
+func parseLoginMode(mode, account string) ([]string, error) {
+	switch mode = strings.ToLower(mode); mode {
+	case "", "user_pass":
+		return nil, nil
+	case "user", "user_pass_acct", "user_acct_pass":
+	default:
+		return nil, errors.Errorf("bad login_mode %q - must be user_pass, user, user_pass_acct or user_acct_pass", mode)
+	}
+	if account == "" && strings.Contains(mode, "acct") {
+		return nil, errors.Errorf("login_mode %s needs account to be set", mode)
+	}
+	return strings.Split(strings.ToUpper(mode), "_"), nil
+}
+
+// loadClientCert reads the PEM encoded client certificate and its
+// private key in clientCert, which is either a file name or the PEM
+// itself.  It returns nil for "" to not send a certificate.
+func loadClientCert(clientCert string) ([]tls.Certificate, error) {
+	if clientCert == "" {
+		return nil, nil
+	}
+	data := []byte(clientCert)
+	if !strings.Contains(clientCert, "-----BEGIN") {
+		var err error
+		data, err = ioutil.ReadFile(clientCert)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	return []tls.Certificate{cert}, nil
+}
+
+// loadCACerts reads the PEM encoded CA certificates in caCert, which
+// is either a file name or the PEM itself, into a pool.  It returns
+// nil for "" to use the system pool.
+func loadCACerts(caCert string) (*x509.CertPool, error) {
+	if caCert == "" {
+		return nil, nil
+	}
+	data := []byte(caCert)
+	if !strings.Contains(caCert, "-----BEGIN") {
+		var err error
+		data, err = ioutil.ReadFile(caCert)
 		if err != nil {
-			if err == fs.ErrorObjectNotFound || errors.Cause(err) == fs.ErrorNotAFile {
-				// File doesn't exist so return old f
-				f.root = root
-				return f, nil
-			}
 			return nil, err
 		}
-		// return an error with an fs which points to the parent
+	}
+	pool := x509.NewCertPool()
+	for n := 1; ; n++ {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			if n == 1 {
+				return nil, errors.New("no PEM encoded certificates found")
+			}
+			return pool, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, errors.Errorf("PEM block %d is %q not a CERTIFICATE", n, block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "certificate %d", n)
+		}
+		pool.AddCert(cert)
+	}
+}
+
+// timezoneOffset matches a time zone given as an offset from UTC
+var timezoneOffset = regexp.MustCompile(`^([+-])(\d\d):?(\d\d)$`)
+
+// parseTimezone parses the timezone option, which is an offset from
+// UTC like "+02:00" or a zone name like "UTC" or "Europe/Berlin",
+// returning nil if it is blank.
+func parseTimezone(timezone string) (*time.Location, error) {
+	if timezone == "" {
+		return nil, nil
+	}
+	if match := timezoneOffset.FindStringSubmatch(timezone); match != nil {
+		hours, _ := strconv.Atoi(match[2])
+		minutes, _ := strconv.Atoi(match[3])
+		offset := hours*3600 + minutes*60
+		if match[1] == "-" {
+			offset = -offset
+		}
+		return time.FixedZone(timezone, offset), nil
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, errors.Wrapf(err, "bad timezone %q", timezone)
+	}
+	return loc, nil
+}
+
+// parseListParser parses the list_parser option, which is blank or
+// one of ftp.ListParsers in any case
+func parseListParser(listParser string) (string, error) {
+	listParser = strings.ToLower(listParser)
+	if listParser == "" {
+		return "", nil
+	}
+	for _, name := range ftp.ListParsers {
+		if listParser == name {
+			return name, nil
+		}
+	}
+	return "", errors.Errorf("bad list_parser %q - must be one of %s", listParser, strings.Join(ftp.ListParsers, ", "))
+}
+
+// parseTrailingSlash parses the trailing_slash option into a value for
+// Fs.trailingSlash
+func parseTrailingSlash(trailingSlash string) (int32, error) {
+	switch strings.ToLower(trailingSlash) {
+	case "", "strip":
+		return slashStrip, nil
+	case "keep":
+		return slashKeep, nil
+	case "auto":
+		return slashAuto, nil
+	}
+	return 0, errors.Errorf("bad trailing_slash %q - must be strip, keep or auto", trailingSlash)
+}
+
+// parseDialNetwork parses the dial_network option returning "tcp" if
+// it isn't set
+func parseDialNetwork(network string) (string, error) {
+	switch network = strings.ToLower(network); network {
+	case "":
+		return "tcp", nil
+	case "tcp", "tcp4", "tcp6":
+		return network, nil
+	}
+	return "", errors.Errorf("bad dial_network %q - must be tcp, tcp4 or tcp6", network)
+}
+
+// parseTLSVersion parses a TLS version such as "1.2" returning 0 for
+// "" to use the default
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, errors.Errorf("unknown TLS version %q - must be 1.0, 1.1, 1.2 or 1.3", version)
+}
+
+// relativeRootNotFound is called by NewFs when changing into the
+// root failed with err as root_is_relative is set.  It checks whether
+// the root is a file returning an Fs pointing at its parent if so.
+func (f *Fs) relativeRootNotFound(err error) (fs.Fs, error) {
+	root := f.cwd
+	f.cwd = path.Dir(root)
+	if f.cwd == "." {
+		f.cwd = ""
+	}
+	// connections change into the parent now so can't be shared
+	// with those changing into the root
+	f.releaseConnPool()
+	f.useConnPool()
+	_, objErr := f.NewObject(path.Base(root))
+	if objErr == nil {
 		return f, fs.ErrorIsFile
 	}
-	return f, err
+	return nil, errors.Wrap(err, "NewFs root directory not found")
 }
 
-// translateErrorFile turns FTP errors into rclone errors if possible for a file
-func translateErrorFile(err error) error {
-	switch errX := err.(type) {
-	case *textproto.Error:
-		switch errX.Code {
-		case ftp.StatusFileUnavailable:
-			err = fs.ErrorObjectNotFound
+// permissionDeniedMessages are lower case fragments of the messages
+// servers send with a 550 or 553 response when the path exists but
+// the user isn't allowed to use it.
+var permissionDeniedMessages = []string{
+	"permission denied",
+	"access denied",
+	"access is denied",
+}
+
+// isPermissionDenied returns true if errX is the server refusing an
+// operation because the user isn't allowed to do it
+func isPermissionDenied(errX *textproto.Error) bool {
+	switch errX.Code {
+	case ftp.StatusStorNeedAccount: // 532
+		return true
+	case ftp.StatusFileUnavailable, ftp.StatusBadFileName: // 550, 553
+		message := strings.ToLower(errX.Msg)
+		for _, denied := range permissionDeniedMessages {
+			if strings.Contains(message, denied) {
+				return true
+			}
 		}
 	}
+	return false
+}
+
+// translatePermissionDenied returns fs.ErrorPermissionDenied if err
+// is the server refusing an operation because the user isn't allowed
+// to do it, otherwise err
+func translatePermissionDenied(err error) error {
+	if errX, ok := errors.Cause(err).(*textproto.Error); ok && isPermissionDenied(errX) {
+		return fs.ErrorPermissionDenied
+	}
+	return err
+}
+
+// translateError turns FTP errors into rclone errors if possible,
+// returning notFound if the file or directory doesn't exist
+func translateError(err error, notFound error) error {
+	errX, ok := err.(*textproto.Error)
+	if !ok {
+		return err
+	}
+	if isPermissionDenied(errX) {
+		return fs.ErrorPermissionDenied
+	}
+	switch errX.Code {
+	case ftp.StatusFileUnavailable: // 550
+		return notFound
+	case ftp.StatusBadFileName: // 553
+		return fserrors.NoRetryError(err)
+	case ftp.StatusExceededStorage: // 552
+		return fserrors.FatalError(err)
+	case ftp.StatusFileActionIgnored: // 450
+		return fserrors.RetryError(err)
+	}
 	return err
 }
 
+// translateErrorFile turns FTP errors into rclone errors if possible for a file
+func translateErrorFile(err error) error {
+	return translateError(err, fs.ErrorObjectNotFound)
+}
+
 // translateErrorDir turns FTP errors into rclone errors if possible for a directory
 func translateErrorDir(err error) error {
-	switch errX := err.(type) {
-	case *textproto.Error:
-		switch errX.Code {
-		case ftp.StatusFileUnavailable:
-			err = fs.ErrorDirNotFound
+	return translateError(err, fs.ErrorDirNotFound)
+}
+
+// run calls fn with a connection from the pool, returning the
+// connection to the pool afterwards.
+//
+// This is for commands which aren't safe to repeat so fn is only
+// retried on a fresh connection if the server replies 421, or once
+// more if it replies 530 and the connection is logged in again, as
+// the command won't have been run.
+func (f *Fs) run(ctx context.Context, fn func(c *ftp.ServerConn) error) error {
+	relogins := 0
+	return f.pacer.Call(func() (bool, error) {
+		c, err := f.getFtpConnection(ctx)
+		if err != nil {
+			return shouldRetry(err)
+		}
+		err = fn(c)
+		if f.putFtpConnection(&c, err) {
+			relogins++
+			if relogins == 1 {
+				return true, err
+			}
 		}
+		return isNotAvailable(err), err
+	})
+}
+
+// list reads the entries in the rooted directory dir retrying on
+// connection failures
+func (f *Fs) list(ctx context.Context, dir string) (files []*ftp.Entry, err error) {
+	reset := func() bool {
+		files = nil
+		return true
 	}
-	return err
+	err = f.listFunc(ctx, dir, reset, func(file *ftp.Entry) error {
+		files = append(files, file)
+		return nil
+	})
+	return files, err
+}
+
+// listFunc reads the entries in the rooted directory dir calling fn
+// with each as it is read, rather than holding them all in memory, for
+// directories with too many entries for that.
+//
+// Connection failures are retried after calling reset to discard any
+// entries already passed to fn, unless it returns false in which case
+// the listing fails.  If the server has logged the connection out the
+// listing is retried once after logging in again.  Errors returned by
+// fn are never retried.
+func (f *Fs) listFunc(ctx context.Context, dir string, reset func() bool, fn func(file *ftp.Entry) error) error {
+	called := false
+	relogins := 0
+	var fnErr error
+	read := func(file *ftp.Entry) error {
+		called = true
+		fnErr = fn(file)
+		return fnErr
+	}
+	return f.pacer.Call(func() (bool, error) {
+		c, err := f.getFtpConnection(ctx)
+		if err != nil {
+			return shouldRetry(errors.Wrap(err, "list"))
+		}
+		viaCwd := func(slash bool) error {
+			return f.listCwd(c, slashDir(dir, slash), read)
+		}
+		if atomic.LoadInt32(&f.cwdListing) != 0 {
+			err = f.dirCommand(dir, viaCwd)
+		} else {
+			err = f.dirCommand(dir, func(slash bool) error {
+				return c.ListFunc(slashDir(dir, slash), read)
+			})
+			if _, isRegularError := errors.Cause(err).(*textproto.Error); isRegularError && dir != "" && !called {
+				cwdErr := f.dirCommand(dir, viaCwd)
+				if cwdErr == nil {
+					fs.Debugf(f, "LIST with a path failed so listing with CWD from now on: %v", err)
+					atomic.StoreInt32(&f.cwdListing, 1)
+					err = nil
+				}
+			}
+		}
+		relogged := f.putFtpConnection(&c, err)
+		if fnErr != nil {
+			return false, fnErr
+		}
+		retry, err := shouldRetry(err)
+		if relogged {
+			// the listing wasn't run so try it once more
+			relogins++
+			retry = relogins == 1
+		}
+		if retry && called {
+			if !reset() {
+				return false, err
+			}
+			called = false
+		}
+		return retry, err
+	})
+}
+
+// listCwd reads the entries in dir into fn by changing into it and
+// listing the working directory, for servers which refuse LIST with a
+// path.  putFtpConnection changes c back to its original directory.
+func (f *Fs) listCwd(c *ftp.ServerConn, dir string, fn func(file *ftp.Entry) error) error {
+	if dir != "" {
+		if err := f.changeDir(c, dir); err != nil {
+			return err
+		}
+	}
+	return c.ListFunc("", fn)
 }
 
 // NewObject finds the Object at remote.  If it can't be found
 // it returns the error fs.ErrorObjectNotFound.
 func (f *Fs) NewObject(remote string) (o fs.Object, err error) {
 	// defer fs.Trace(remote, "")("o=%v, err=%v", &o, &err)
-	fullPath := path.Join(f.root, remote)
-	dir := path.Dir(fullPath)
-	base := path.Base(fullPath)
+	fullPath := f.fullPath(remote)
+	if err := checkPath(fullPath); err != nil {
+		return nil, err
+	}
+	_, base := splitPath(fullPath)
+	if base == "" {
+		return nil, fs.ErrorNotAFile
+	}
+	ctx := context.Background()
+	var info *FileInfo
+	switch {
+	case f.serverFeatures.has("MLST"):
+		info, err = f.statMLST(ctx, fullPath)
+	case f.serverFeatures.has("SIZE") && f.serverFeatures.has("MDTM"):
+		info, err = f.statSizeMDTM(ctx, fullPath)
+	default:
+		var ok bool
+		info, ok, err = f.statSTAT(ctx, fullPath)
+		if !ok {
+			info, err = f.statList(ctx, fullPath)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	info.Name = remote
+	o = &Object{
+		fs:     f,
+		remote: remote,
+		info:   info,
+	}
+	return o, nil
+}
+
+// statMLST reads the FileInfo for the file at the rooted path
+// fullPath with a single MLST command.
+//
+// It returns fs.ErrorObjectNotFound if it doesn't exist or is a
+// directory and fs.ErrorNotAFile if it is some other type.  Symlinks
+// and replies without the size and modify facts are looked up by
+// listing the directory instead.
+func (f *Fs) statMLST(ctx context.Context, fullPath string) (info *FileInfo, err error) {
+	var message string
+	err = f.pacer.Call(func() (bool, error) {
+		c, err := f.getFtpConnection(ctx)
+		if err != nil {
+			return shouldRetry(err)
+		}
+		var code int
+		code, message, err = c.Quote("MLST %s", fullPath)
+		if err == nil && code != ftp.StatusRequestedFileActionOK {
+			err = &textproto.Error{Code: code, Msg: message}
+		}
+		f.putFtpConnection(&c, err)
+		return shouldRetry(err)
+	})
+	if err != nil {
+		return nil, translateErrorFile(err)
+	}
+	facts, err := parseMLST(message)
+	if err != nil {
+		return nil, err
+	}
+	fileType := facts["type"]
+	switch {
+	case fileType == "dir" || fileType == "cdir" || fileType == "pdir":
+		return nil, fs.ErrorObjectNotFound
+	case strings.HasPrefix(fileType, "os.unix=slink") || strings.HasPrefix(fileType, "os.unix=symlink"):
+		return f.statList(ctx, fullPath)
+	case fileType != "file":
+		return nil, fs.ErrorNotAFile
+	}
+	size, sizeErr := strconv.ParseUint(facts["size"], 10, 64)
+	modTime, timeErr := time.Parse("20060102150405", facts["modify"])
+	if sizeErr != nil || timeErr != nil {
+		fs.Debugf(f, "MLST %q: missing or bad size or modify facts - listing instead", fullPath)
+		return f.statList(ctx, fullPath)
+	}
+	return &FileInfo{
+		Size:    size,
+		ModTime: modTime,
+	}, nil
+}
+
+// parseMLST parses the facts from the message of an MLST reply.
+// Between its first and last lines this has a line of facts like
+// "type=file;size=1024;modify=20180813133357; /path".
+//
+// The fact names and the type fact are returned in lower case as
+// servers vary in the case they use.
+func parseMLST(message string) (facts map[string]string, err error) {
+	lines := strings.Split(message, "\n")
+	if len(lines) < 3 {
+		return nil, errors.Errorf("MLST: bad reply %q", message)
+	}
+	for _, line := range lines[1 : len(lines)-1] {
+		line = strings.TrimPrefix(line, " ")
+		space := strings.Index(line, " ")
+		if space < 0 || !strings.Contains(line[:space], "=") {
+			continue
+		}
+		facts = map[string]string{}
+		for _, fact := range strings.Split(line[:space], ";") {
+			equals := strings.Index(fact, "=")
+			if equals < 1 {
+				continue
+			}
+			facts[strings.ToLower(fact[:equals])] = fact[equals+1:]
+		}
+		facts["type"] = strings.ToLower(facts["type"])
+		return facts, nil
+	}
+	return nil, errors.Errorf("MLST: no facts in reply %q", message)
+}
+
+// statSizeMDTM reads the FileInfo for the file at the rooted path
+// fullPath with the SIZE and MDTM commands.
+//
+// It returns fs.ErrorObjectNotFound if it doesn't exist or isn't a
+// file as servers refuse SIZE for directories.
+func (f *Fs) statSizeMDTM(ctx context.Context, fullPath string) (info *FileInfo, err error) {
+	var size int64
+	var modTime time.Time
+	err = f.pacer.Call(func() (bool, error) {
+		c, err := f.getFtpConnection(ctx)
+		if err != nil {
+			return shouldRetry(err)
+		}
+		size, err = c.FileSize(fullPath)
+		if err == nil {
+			modTime, err = c.GetTime(fullPath)
+		}
+		f.putFtpConnection(&c, err)
+		return shouldRetry(err)
+	})
+	if err != nil {
+		return nil, translateErrorFile(err)
+	}
+	return &FileInfo{
+		Size:    uint64(size),
+		ModTime: modTime,
+	}, nil
+}
+
+// Values for Fs.statSupport
+const (
+	statUnknown int32 = iota // STAT hasn't listed a file yet
+	statWorks                // STAT has listed a file
+	statBroken               // the server doesn't support STAT
+)
+
+// statSTAT reads the FileInfo for the file at the rooted path
+// fullPath with STAT, which lists it over the control connection so
+// is quicker than listing its directory.
+//
+// Servers may not support STAT with a path, or reply with their
+// status instead of a listing, so the replies are only trusted to
+// say a file doesn't exist once STAT has listed one.  Empty
+// directories list the same as missing paths so aren't found either.
+// ok is false if the directory should be listed instead, eg for
+// directories and symlinks.
+func (f *Fs) statSTAT(ctx context.Context, fullPath string) (info *FileInfo, ok bool, err error) {
+	support := atomic.LoadInt32(&f.statSupport)
+	if support == statBroken {
+		return nil, false, nil
+	}
+	var files []*ftp.Entry
+	err = f.pacer.Call(func() (bool, error) {
+		c, err := f.getFtpConnection(ctx)
+		if err != nil {
+			return shouldRetry(err)
+		}
+		files, err = c.Stat(fullPath)
+		f.putFtpConnection(&c, err)
+		return shouldRetry(err)
+	})
+	if isNotImplemented(err) {
+		fs.Debugf(f, "Server doesn't support STAT - listing instead: %v", err)
+		atomic.StoreInt32(&f.statSupport, statBroken)
+		return nil, false, nil
+	}
+	if err != nil {
+		err = translateErrorFile(err)
+		return nil, err == fs.ErrorObjectNotFound && support == statWorks, err
+	}
+	// a file lists as itself, sometimes with its full path, and a
+	// directory as its contents
+	_, base := splitPath(fullPath)
+	if len(files) == 1 {
+		files[0].Name = path.Base(files[0].Name)
+	}
+	if len(files) != 1 || len(f.matchName(files, base)) != 1 {
+		return nil, len(files) == 0 && support == statWorks, fs.ErrorObjectNotFound
+	}
+	file := files[0]
+	switch file.Type {
+	case ftp.EntryTypeFile:
+	case ftp.EntryTypeLink:
+		if f.followSymlinks {
+			return nil, false, nil
+		}
+	default:
+		return nil, false, nil
+	}
+	atomic.StoreInt32(&f.statSupport, statWorks)
+	info = &FileInfo{
+		Size:        file.Size,
+		ModTime:     file.Time,
+		sizeUnknown: f.listSizeUnknown(file),
+	}
+	f.readModTime(ctx, fullPath, info)
+	return info, true, nil
+}
 
-	c, err := f.getFtpConnection()
-	if err != nil {
-		return nil, errors.Wrap(err, "NewObject")
+// matchName returns the entries in files called name.  If the server
+// is case insensitive entries whose names differ only in case match
+// too, after any exact match.
+func (f *Fs) matchName(files []*ftp.Entry, name string) (matches []*ftp.Entry) {
+	var folded []*ftp.Entry
+	for _, file := range files {
+		if file.Name == name {
+			matches = append(matches, file)
+		} else if f.ignoreCase && strings.EqualFold(file.Name, name) {
+			folded = append(folded, file)
+		}
 	}
-	files, err := c.List(dir)
-	f.putFtpConnection(&c, err)
+	return append(matches, folded...)
+}
+
+// statList reads the FileInfo for the file at the rooted path
+// fullPath by listing its directory.
+//
+// It returns fs.ErrorObjectNotFound if it doesn't exist or isn't a
+// file.
+func (f *Fs) statList(ctx context.Context, fullPath string) (info *FileInfo, err error) {
+	dir, base := splitPath(fullPath)
+	files, err := f.list(ctx, dir)
 	if err != nil {
 		return nil, translateErrorFile(err)
 	}
-	for i, file := range files {
-		if file.Type != ftp.EntryTypeFolder && file.Name == base {
-			o := &Object{
-				fs:     f,
-				remote: remote,
+	for _, file := range f.matchName(files, base) {
+		if file.Type == ftp.EntryTypeLink && f.followSymlinks {
+			err = f.resolveLink(ctx, fullPath, file)
+			if err != nil {
+				return nil, err
 			}
-			info := &FileInfo{
-				Name:    remote,
-				Size:    files[i].Size,
-				ModTime: files[i].Time,
+		}
+		if file.Type != ftp.EntryTypeFolder {
+			info = &FileInfo{
+				Size:        file.Size,
+				ModTime:     file.Time,
+				sizeUnknown: f.listSizeUnknown(file),
 			}
-			o.info = info
-
-			return o, nil
+			f.readModTime(ctx, fullPath, info)
+			return info, nil
 		}
 	}
 	return nil, fs.ErrorObjectNotFound
 }
 
+// listSizeUnknown returns true if the size of the file in a listing
+// may be wrong and should be read with SIZE when it is needed.
+//
+// Listings give a size of 0 if the server's format has no size or
+// can't be parsed, which can't be told apart from an empty file.
+func (f *Fs) listSizeUnknown(file *ftp.Entry) bool {
+	return file.Size == 0 && f.serverFeatures.has("SIZE")
+}
+
 // List the objects and directories in dir into entries.  The
 // entries can be returned in any order but should be for a
 // complete directory.
@@ -313,40 +3136,202 @@ func (f *Fs) NewObject(remote string) (o fs.Object, err error) {
 // found.
 func (f *Fs) List(dir string) (entries fs.DirEntries, err error) {
 	// defer fs.Trace(dir, "curlevel=%d", curlevel)("")
-	c, err := f.getFtpConnection()
+	ctx := context.Background()
+	reset := func() bool {
+		entries = nil
+		return true
+	}
+	err = f.listEntries(ctx, dir, reset, func(file *ftp.Entry, entry fs.DirEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
 	if err != nil {
-		return nil, errors.Wrap(err, "list")
+		return nil, err
+	}
+	return entries, nil
+}
+
+// listEntries lists dir calling fn with each DirEntry as it is read
+// along with the listing entry it was made from, so only the
+// DirEntries need be kept.  Entries which should be skipped aren't
+// passed to fn.  reset is as for listFunc.
+//
+// With follow_symlinks the symlinks are resolved after the listing
+// is complete as that needs another connection.
+func (f *Fs) listEntries(ctx context.Context, dir string, reset func() bool, fn func(file *ftp.Entry, entry fs.DirEntry) error) error {
+	var links []*ftp.Entry
+	var fnErr error
+	resetLinks := func() bool {
+		links = nil
+		return reset()
+	}
+	err := f.listFunc(ctx, f.fullPath(dir), resetLinks, func(file *ftp.Entry) error {
+		if file.Type == ftp.EntryTypeLink && f.followSymlinks && !badName(file.Name) {
+			links = append(links, file)
+			return nil
+		}
+		entry, _ := f.dirEntry(ctx, dir, file)
+		if entry != nil {
+			fnErr = fn(file, entry)
+		}
+		return fnErr
+	})
+	if fnErr != nil {
+		return fnErr
 	}
-	files, err := c.List(path.Join(f.root, dir))
-	f.putFtpConnection(&c, err)
 	if err != nil {
-		return nil, translateErrorDir(err)
+		return translateErrorDir(err)
 	}
-	for i := range files {
-		object := files[i]
-		newremote := path.Join(dir, object.Name)
-		switch object.Type {
-		case ftp.EntryTypeFolder:
-			if object.Name == "." || object.Name == ".." {
-				continue
-			}
-			d := fs.NewDir(newremote, object.Time)
-			entries = append(entries, d)
-		default:
-			o := &Object{
-				fs:     f,
-				remote: newremote,
+	for _, file := range links {
+		entry, err := f.dirEntry(ctx, dir, file)
+		if err != nil {
+			return err
+		}
+		if entry != nil {
+			if err = fn(file, entry); err != nil {
+				return err
 			}
-			info := &FileInfo{
-				Name:    newremote,
-				Size:    object.Size,
-				ModTime: object.Time,
+		}
+	}
+	return nil
+}
+
+// ListR lists the objects and directories of the Fs starting
+// from dir recursively, calling callback with each directory's entries.
+//
+// Symlinks to directories are only followed with follow_symlinks, and
+// never into a directory which contains them so loops are skipped.
+func (f *Fs) ListR(dir string, callback fs.ListRCallback) error {
+	ctx := context.Background()
+	// The real paths of directories are compared to find loops
+	// so relative paths need the directory they are relative to
+	realPath := path.Clean(f.fullPath(dir))
+	if !path.IsAbs(realPath) {
+		err := f.run(ctx, func(c *ftp.ServerConn) error {
+			cwd, err := c.CurrentDir()
+			realPath = path.Join(cwd, realPath)
+			return err
+		})
+		if err != nil {
+			return errors.Wrap(err, "ListR")
+		}
+	}
+	return f.listR(ctx, dir, realPath, 1, map[string]bool{realPath: true}, callback)
+}
+
+// listRBatch is the number of entries ListR passes to its callback
+// at once while listing a directory
+const listRBatch = 1024
+
+// listR lists dir, which is at realPath on the server once symlinks
+// are resolved, and everything below it into callback.  ancestors
+// are the real paths of dir and the directories above it.
+//
+// The entries are passed to callback in batches of listRBatch as they
+// are read so huge directories needn't be held in memory, while the
+// listing connection is still in use.  Only the subdirectories are
+// kept to list after.
+func (f *Fs) listR(ctx context.Context, dir, realPath string, depth int, ancestors map[string]bool, callback fs.ListRCallback) error {
+	var (
+		batch   fs.DirEntries
+		subdirs []*ftp.Entry
+		sent    bool // set once a batch has gone to callback
+	)
+	reset := func() bool {
+		batch, subdirs = nil, nil
+		return !sent
+	}
+	err := f.listEntries(ctx, dir, reset, func(file *ftp.Entry, entry fs.DirEntry) error {
+		if file.Type == ftp.EntryTypeFolder {
+			subdirs = append(subdirs, file)
+		}
+		batch = append(batch, entry)
+		if len(batch) < listRBatch {
+			return nil
+		}
+		sent = true
+		err := callback(batch)
+		batch = nil
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(batch) > 0 || !sent {
+		err = callback(batch)
+		if err != nil {
+			return err
+		}
+	}
+	for _, file := range subdirs {
+		subdir := path.Join(dir, file.Name)
+		// followed symlinks keep their target
+		subRealPath := path.Join(realPath, file.Name)
+		if file.Target != "" {
+			subRealPath = file.Target
+			if !path.IsAbs(subRealPath) {
+				subRealPath = path.Join(realPath, subRealPath)
 			}
-			o.info = info
-			entries = append(entries, o)
+		}
+		if ancestors[subRealPath] {
+			fs.Logf(f, "Not listing %q as it is a symlink to %q which contains it", subdir, subRealPath)
+			continue
+		}
+		if f.maxListDepth > 0 && depth >= f.maxListDepth {
+			return errors.Errorf("ListR: %q is deeper than max_list_depth %d", subdir, f.maxListDepth)
+		}
+		ancestors[subRealPath] = true
+		err = f.listR(ctx, subdir, subRealPath, depth+1, ancestors, callback)
+		delete(ancestors, subRealPath)
+		if err != nil {
+			return err
 		}
 	}
-	return entries, nil
+	return nil
+}
+
+// badName returns true if name from a listing can't be the name of an
+// entry in the directory.  Besides "." and ".." some servers list
+// entries with blank names.
+func badName(name string) bool {
+	return strings.TrimSpace(name) == "" || name == "." || name == ".."
+}
+
+// dirEntry turns object listed in dir into a DirEntry, or nil if it
+// should be skipped.  Only resolving a symlink with follow_symlinks
+// can fail, which needs a connection to the server.
+func (f *Fs) dirEntry(ctx context.Context, dir string, object *ftp.Entry) (fs.DirEntry, error) {
+	if badName(object.Name) {
+		if object.Name != "." && object.Name != ".." {
+			fs.Debugf(f, "Skipping entry with bad name %q in %q", object.Name, dir)
+		}
+		return nil, nil
+	}
+	newremote := path.Join(dir, object.Name)
+	if object.Type == ftp.EntryTypeLink && f.followSymlinks {
+		err := f.resolveLink(ctx, f.fullPath(newremote), object)
+		if err == fs.ErrorObjectNotFound {
+			fs.Logf(f, "Skipping broken symlink %q -> %q", newremote, object.Target)
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if object.Type == ftp.EntryTypeFolder {
+		return fs.NewDir(newremote, object.Time), nil
+	}
+	o := &Object{
+		fs:     f,
+		remote: newremote,
+	}
+	o.info = &FileInfo{
+		Name:        newremote,
+		Size:        object.Size,
+		ModTime:     object.Time,
+		sizeUnknown: f.listSizeUnknown(object),
+		roughTime:   !f.serverFeatures.has("MLST"),
+	}
+	return o, nil
 }
 
 // Hashes are not supported
@@ -354,8 +3339,13 @@ func (f *Fs) Hashes() hash.Set {
 	return 0
 }
 
-// Precision shows Modified Time not supported
+// Precision of the modification times, which is a second if the
+// server can set them and read them exactly with MDTM or MLST,
+// otherwise they aren't supported
 func (f *Fs) Precision() time.Duration {
+	if f.canSetModTime() && (f.serverFeatures.has("MDTM") || f.serverFeatures.has("MLST")) {
+		return time.Second
+	}
 	return fs.ModTimeNotSupported
 }
 
@@ -365,8 +3355,26 @@ func (f *Fs) Precision() time.Duration {
 // will return the object and the error, otherwise will return
 // nil and the error
 func (f *Fs) Put(in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
+	if f.readOnly {
+		return nil, errorReadOnly
+	}
+	return f.put(in, src, options...)
+}
+
+// PutStream uploads to the remote path with the modTime given of indeterminate size
+//
+// The data is streamed to the server as it is read.
+func (f *Fs) PutStream(in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
+	if f.readOnly {
+		return nil, errorReadOnly
+	}
+	return f.put(in, src, options...)
+}
+
+// put uploads in to a new object
+func (f *Fs) put(in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
 	// fs.Debugf(f, "Trying to put file %s", src.Remote())
-	err := f.mkParentDir(src.Remote())
+	err := f.mkParentDir(context.Background(), src.Remote())
 	if err != nil {
 		return nil, errors.Wrap(err, "Put mkParentDir failed")
 	}
@@ -378,116 +3386,336 @@ func (f *Fs) Put(in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.
 	return o, err
 }
 
-// PutStream uploads to the remote path with the modTime given of indeterminate size
-func (f *Fs) PutStream(in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
-	return f.Put(in, src, options...)
+// splitPath splits the rooted path p into the directory to list to
+// find it and its name.
+//
+// The directory is "" for paths in the login directory so it is
+// listed with a plain LIST as some servers reject "LIST ." and base
+// is "" if p is the root itself.
+func splitPath(p string) (dir, base string) {
+	p = path.Clean(p)
+	if p == "." || p == "/" {
+		return p, ""
+	}
+	dir, base = path.Split(p)
+	if dir != "/" {
+		dir = strings.TrimSuffix(dir, "/")
+	}
+	return dir, base
 }
 
-// getInfo reads the FileInfo for a path
-func (f *Fs) getInfo(remote string) (fi *FileInfo, err error) {
-	// defer fs.Trace(remote, "")("fi=%v, err=%v", &fi, &err)
-	dir := path.Dir(remote)
-	base := path.Base(remote)
-
-	c, err := f.getFtpConnection()
-	if err != nil {
-		return nil, errors.Wrap(err, "getInfo")
+// getInfo reads the FileInfo for the file or directory at fullPath,
+// the path on the server as returned by fullPath.
+//
+// The Name of the FileInfo is left for the caller to set to the
+// remote path as only it knows that.
+func (f *Fs) getInfo(ctx context.Context, fullPath string) (fi *FileInfo, err error) {
+	// defer fs.Trace(fullPath, "")("fi=%v, err=%v", &fi, &err)
+	if err := checkPath(fullPath); err != nil {
+		return nil, err
+	}
+	dir, base := splitPath(fullPath)
+	if base == "" {
+		// the root is always a directory
+		return &FileInfo{IsDir: true}, nil
+	}
+	// STAT only finds files as empty directories list the same
+	// as missing paths
+	if info, ok, err := f.statSTAT(ctx, fullPath); ok && err == nil {
+		return info, nil
 	}
-	files, err := c.List(dir)
-	f.putFtpConnection(&c, err)
+
+	files, err := f.list(ctx, dir)
 	if err != nil {
 		return nil, translateErrorFile(err)
 	}
 
-	for i := range files {
-		if files[i].Name == base {
-			info := &FileInfo{
-				Name:    remote,
-				Size:    files[i].Size,
-				ModTime: files[i].Time,
-				IsDir:   files[i].Type == ftp.EntryTypeFolder,
+	for _, file := range f.matchName(files, base) {
+		if file.Type == ftp.EntryTypeLink && f.followSymlinks {
+			err = f.resolveLink(ctx, fullPath, file)
+			if err != nil {
+				return nil, err
 			}
-			return info, nil
 		}
+		info := &FileInfo{
+			Size:    file.Size,
+			ModTime: file.Time,
+			IsDir:   file.Type == ftp.EntryTypeFolder,
+		}
+		if !info.IsDir {
+			f.readModTime(ctx, fullPath, info)
+		}
+		return info, nil
 	}
 	return nil, fs.ErrorObjectNotFound
 }
 
-// mkdir makes the directory and parents using unrooted paths
-func (f *Fs) mkdir(abspath string) error {
-	if abspath == "." || abspath == "/" {
+// readModTime replaces the time from the listing in info with the
+// precise time from MDTM if the server supports it.
+//
+// The listing time is kept if MDTM fails.
+func (f *Fs) readModTime(ctx context.Context, fullPath string, info *FileInfo) {
+	if !f.serverFeatures.has("MDTM") {
+		return
+	}
+	var modTime time.Time
+	err := f.pacer.Call(func() (bool, error) {
+		c, err := f.getFtpConnection(ctx)
+		if err != nil {
+			return shouldRetry(err)
+		}
+		modTime, err = c.GetTime(fullPath)
+		f.putFtpConnection(&c, err)
+		return shouldRetry(err)
+	})
+	if err != nil {
+		fs.Debugf(f, "Using listing time for %q as MDTM failed: %v", fullPath, err)
+		return
+	}
+	info.ModTime = modTime
+}
+
+// resolveLink finds out whether the symlink entry at the rooted path
+// fullPath points to a directory or a file and updates entry to match.
+//
+// This uses MLST if the server supports it, otherwise it tries to CWD
+// into the link and if that fails reads the size with SIZE if the
+// server supports it.
+//
+// It returns fs.ErrorObjectNotFound if the link is known to be broken.
+func (f *Fs) resolveLink(ctx context.Context, fullPath string, entry *ftp.Entry) error {
+	var target ftp.Entry
+	err := f.pacer.Call(func() (bool, error) {
+		c, err := f.getFtpConnection(ctx)
+		if err != nil {
+			return shouldRetry(err)
+		}
+		target = *entry
+		err = f.statLink(c, fullPath, &target)
+		f.putFtpConnection(&c, err)
+		return shouldRetry(err)
+	})
+	if err != nil {
+		return translateErrorFile(err)
+	}
+	*entry = target
+	return nil
+}
+
+// statLink does the work for resolveLink on c
+func (f *Fs) statLink(c *ftp.ServerConn, fullPath string, entry *ftp.Entry) error {
+	if f.serverFeatures.has("MLST") {
+		target, err := c.GetEntry(fullPath)
+		if err != nil {
+			return err
+		}
+		entry.Type, entry.Size = target.Type, target.Size
+		if !target.Time.IsZero() {
+			entry.Time = target.Time
+		}
+		return nil
+	}
+	err := f.changeDir(c, fullPath)
+	if err == nil {
+		entry.Type = ftp.EntryTypeFolder
+		return nil
+	}
+	if _, isRegularError := err.(*textproto.Error); !isRegularError {
+		return err
+	}
+	entry.Type = ftp.EntryTypeFile
+	if f.serverFeatures.has("SIZE") {
+		size, err := c.FileSize(fullPath)
+		if err != nil {
+			return err
+		}
+		entry.Size = uint64(size)
+	}
+	return nil
+}
+
+// mkdir makes the directory at dirPath, a path on the server as
+// returned by fullPath, and its parents
+func (f *Fs) mkdir(ctx context.Context, dirPath string) error {
+	if _, base := splitPath(dirPath); base == "" {
 		return nil
 	}
-	fi, err := f.getInfo(abspath)
+	fi, err := f.getInfo(ctx, dirPath)
 	if err == nil {
 		if fi.IsDir {
 			return nil
 		}
 		return fs.ErrorIsFile
 	} else if err != fs.ErrorObjectNotFound {
-		return errors.Wrapf(err, "mkdir %q failed", abspath)
+		return errors.Wrapf(err, "mkdir %q failed", dirPath)
 	}
-	parent := path.Dir(abspath)
-	err = f.mkdir(parent)
+	parent, _ := splitPath(dirPath)
+	err = f.mkdir(ctx, parent)
 	if err != nil {
 		return err
 	}
-	c, connErr := f.getFtpConnection()
-	if connErr != nil {
-		return errors.Wrap(connErr, "mkdir")
+	err = f.run(ctx, func(c *ftp.ServerConn) error {
+		return f.dirCommand(dirPath, func(slash bool) error {
+			return c.MakeDir(slashDir(dirPath, slash))
+		})
+	})
+	if _, isRegularError := errors.Cause(err).(*textproto.Error); isRegularError {
+		// Something else may have made the directory since it
+		// was checked, so the server refused to make it again,
+		// usually with a 550 or 521 saying it exists
+		if fi, infoErr := f.getInfo(ctx, dirPath); infoErr == nil && fi.IsDir {
+			fs.Debugf(f, "Directory %q was made at the same time: %v", dirPath, err)
+			return nil
+		}
 	}
-	err = c.MakeDir(abspath)
-	f.putFtpConnection(&c, err)
-	return err
+	return translatePermissionDenied(err)
 }
 
 // mkParentDir makes the parent of remote if necessary and any
 // directories above that
-func (f *Fs) mkParentDir(remote string) error {
+func (f *Fs) mkParentDir(ctx context.Context, remote string) error {
 	parent := path.Dir(remote)
-	return f.mkdir(path.Join(f.root, parent))
+	return f.mkdir(ctx, f.fullPath(parent))
 }
 
 // Mkdir creates the directory if it doesn't exist
 func (f *Fs) Mkdir(dir string) (err error) {
 	// defer fs.Trace(dir, "")("err=%v", &err)
-	root := path.Join(f.root, dir)
-	return f.mkdir(root)
+	if f.readOnly {
+		return errorReadOnly
+	}
+	root := f.fullPath(dir)
+	return f.mkdir(context.Background(), root)
 }
 
 // Rmdir removes the directory (container, bucket) if empty
 //
 // Return an error if it doesn't exist or isn't empty
 func (f *Fs) Rmdir(dir string) error {
-	c, err := f.getFtpConnection()
-	if err != nil {
-		return errors.Wrap(translateErrorFile(err), "Rmdir")
+	if f.readOnly {
+		return errorReadOnly
+	}
+	ctx := context.Background()
+	dirPath := f.fullPath(dir)
+	err := f.run(ctx, func(c *ftp.ServerConn) error {
+		return f.dirCommand(dirPath, func(slash bool) error {
+			return c.RemoveDir(slashDir(dirPath, slash))
+		})
+	})
+	if errX, ok := errors.Cause(err).(*textproto.Error); ok && errX.Code == ftp.StatusFileUnavailable {
+		return f.rmdirError(ctx, dirPath, err)
 	}
-	err = c.RemoveDir(path.Join(f.root, dir))
-	f.putFtpConnection(&c, err)
 	return translateErrorDir(err)
 }
 
+// rmdirError works out why removing dirPath failed with err by
+// listing it as servers reply 550 whether it is missing or isn't
+// empty.
+//
+// It returns fs.ErrorDirNotFound or fs.ErrorDirectoryNotEmpty if it
+// can tell or err if not.
+func (f *Fs) rmdirError(ctx context.Context, dirPath string, err error) error {
+	files, listErr := f.list(ctx, dirPath)
+	if listErr != nil {
+		if listErr = translateErrorDir(listErr); listErr == fs.ErrorDirNotFound {
+			return listErr
+		}
+		return translatePermissionDenied(err)
+	}
+	for _, file := range files {
+		if !badName(file.Name) {
+			return fs.ErrorDirectoryNotEmpty
+		}
+	}
+	return translatePermissionDenied(err)
+}
+
+// Copy src to this remote using server side copy operations.
+//
+// This uses the SITE CPFR and SITE CPTO commands from ProFTPD's
+// mod_copy so needs the server to advertise SITE COPY.
+//
+// This is stored with the remote path given
+//
+// It returns the destination Object and a possible error
+//
+// Will only be called if src.Fs().Name() == f.Name()
+//
+// If it isn't possible then return fs.ErrorCantCopy
+func (f *Fs) Copy(src fs.Object, remote string) (fs.Object, error) {
+	if f.readOnly {
+		return nil, errorReadOnly
+	}
+	srcObj, ok := src.(*Object)
+	if !ok {
+		fs.Debugf(src, "Can't copy - not same remote type")
+		return nil, fs.ErrorCantCopy
+	}
+	if !f.serverFeatures.has("SITE COPY") {
+		fs.Debugf(src, "Can't copy - server doesn't support SITE COPY")
+		return nil, fs.ErrorCantCopy
+	}
+	ctx := context.Background()
+	err := f.mkParentDir(ctx, remote)
+	if err != nil {
+		return nil, errors.Wrap(err, "Copy mkParentDir failed")
+	}
+	err = f.run(ctx, func(c *ftp.ServerConn) error {
+		return siteCopy(c, srcObj.fs.fullPath(srcObj.remote), f.fullPath(remote))
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Copy failed")
+	}
+	dstObj, err := f.NewObject(remote)
+	if err != nil {
+		return nil, errors.Wrap(err, "Copy NewObject failed")
+	}
+	return dstObj, nil
+}
+
+// siteCopy copies from to to on the server with SITE CPFR/CPTO
+func siteCopy(c *ftp.ServerConn, from, to string) error {
+	code, message, err := c.Quote("SITE CPFR %s", from)
+	if err != nil {
+		return err
+	}
+	if code != ftp.StatusRequestFilePending {
+		return &textproto.Error{Code: code, Msg: message}
+	}
+	code, message, err = c.Quote("SITE CPTO %s", to)
+	if err != nil {
+		return err
+	}
+	if code != ftp.StatusRequestedFileActionOK {
+		return &textproto.Error{Code: code, Msg: message}
+	}
+	return nil
+}
+
 // Move renames a remote file object
 func (f *Fs) Move(src fs.Object, remote string) (fs.Object, error) {
+	if f.readOnly {
+		return nil, errorReadOnly
+	}
 	srcObj, ok := src.(*Object)
 	if !ok {
 		fs.Debugf(src, "Can't move - not same remote type")
 		return nil, fs.ErrorCantMove
 	}
-	err := f.mkParentDir(remote)
-	if err != nil {
-		return nil, errors.Wrap(err, "Move mkParentDir failed")
+	if srcObj.fs.readOnly {
+		return nil, errorReadOnly
 	}
-	c, err := f.getFtpConnection()
+	ctx := context.Background()
+	err := f.mkParentDir(ctx, remote)
 	if err != nil {
-		return nil, errors.Wrap(err, "Move")
+		return nil, errors.Wrap(err, "Move mkParentDir failed")
 	}
-	err = c.Rename(
-		path.Join(srcObj.fs.root, srcObj.remote),
-		path.Join(f.root, remote),
-	)
-	f.putFtpConnection(&c, err)
+	err = f.run(ctx, func(c *ftp.ServerConn) error {
+		return f.rename(c,
+			srcObj.fs.fullPath(srcObj.remote),
+			f.fullPath(remote),
+		)
+	})
 	if err != nil {
 		return nil, errors.Wrap(err, "Move Rename failed")
 	}
@@ -498,6 +3726,38 @@ func (f *Fs) Move(src fs.Object, remote string) (fs.Object, error) {
 	return dstObj, nil
 }
 
+// caseOnly returns true if from and to differ only in case on a
+// case insensitive server so they are the same file
+func (f *Fs) caseOnly(from, to string) bool {
+	return f.ignoreCase && from != to && strings.EqualFold(from, to)
+}
+
+// rename renames from to to.  Case insensitive servers may refuse
+// or ignore a rename which only changes the case as to already
+// exists so that is done in two steps through a temporary name.
+func (f *Fs) rename(c *ftp.ServerConn, from, to string) error {
+	if !f.caseOnly(from, to) {
+		return c.Rename(from, to)
+	}
+	// keep any trailing slash on directory paths
+	tmp := tempName(strings.TrimSuffix(to, "/"))
+	if strings.HasSuffix(to, "/") {
+		tmp += "/"
+	}
+	err := c.Rename(from, tmp)
+	if err != nil {
+		return err
+	}
+	err = c.Rename(tmp, to)
+	if err != nil {
+		if undoErr := c.Rename(tmp, from); undoErr != nil {
+			fs.Errorf(f, "Failed to rename %q back to %q: %v", tmp, from, undoErr)
+		}
+		return err
+	}
+	return nil
+}
+
 // DirMove moves src, srcRemote to this remote at dstRemote
 // using server side move operations.
 //
@@ -507,16 +3767,38 @@ func (f *Fs) Move(src fs.Object, remote string) (fs.Object, error) {
 //
 // If destination exists then return fs.ErrorDirExists
 func (f *Fs) DirMove(src fs.Fs, srcRemote, dstRemote string) error {
+	if f.readOnly {
+		return errorReadOnly
+	}
 	srcFs, ok := src.(*Fs)
 	if !ok {
 		fs.Debugf(srcFs, "Can't move directory - not same remote type")
 		return fs.ErrorCantDirMove
 	}
-	srcPath := path.Join(srcFs.root, srcRemote)
-	dstPath := path.Join(f.root, dstRemote)
+	if srcFs.readOnly {
+		return errorReadOnly
+	}
+	srcPath := srcFs.fullPath(srcRemote)
+	dstPath := f.fullPath(dstRemote)
+
+	// Check the source exists and is a directory
+	ctx := context.Background()
+	fi, err := srcFs.getInfo(ctx, srcPath)
+	if err == fs.ErrorObjectNotFound {
+		return fs.ErrorDirNotFound
+	} else if err != nil {
+		return errors.Wrapf(err, "DirMove getInfo src failed")
+	}
+	if !fi.IsDir {
+		return fs.ErrorIsFile
+	}
 
-	// Check if destination exists
-	fi, err := f.getInfo(dstPath)
+	// Check if destination exists, which it will appear to if
+	// only the case is changing on a case insensitive server
+	fi, err = f.getInfo(ctx, dstPath)
+	if err == nil && f.caseOnly(srcPath, dstPath) {
+		err = fs.ErrorObjectNotFound
+	}
 	if err == nil {
 		if fi.IsDir {
 			return fs.ErrorDirExists
@@ -527,23 +3809,64 @@ func (f *Fs) DirMove(src fs.Fs, srcRemote, dstRemote string) error {
 	}
 
 	// Make sure the parent directory exists
-	err = f.mkdir(path.Dir(dstPath))
+	err = f.mkdir(ctx, path.Dir(dstPath))
 	if err != nil {
 		return errors.Wrap(err, "DirMove mkParentDir dst failed")
 	}
 
 	// Do the move
-	c, err := f.getFtpConnection()
+	err = f.run(ctx, func(c *ftp.ServerConn) error {
+		return f.dirCommand(srcPath, func(slash bool) error {
+			return f.rename(c, slashDir(srcPath, slash), slashDir(dstPath, slash))
+		})
+	})
 	if err != nil {
-		return errors.Wrap(err, "DirMove")
+		return errors.Wrapf(err, "DirMove Rename(%q,%q) failed", srcPath, dstPath)
 	}
-	err = c.Rename(
-		srcPath,
-		dstPath,
-	)
-	f.putFtpConnection(&c, err)
+	return nil
+}
+
+// CleanUp removes the temporary files left behind by interrupted
+// uploads, which are the files whose names match cleanup_pattern.
+//
+// With --dry-run the files are only logged.
+func (f *Fs) CleanUp() error {
+	if f.readOnly {
+		return errorReadOnly
+	}
+	var errs int
+	err := walk.Walk(f, "", true, -1, func(dirPath string, entries fs.DirEntries, err error) error {
+		if err != nil {
+			fs.Errorf(f, "CleanUp: failed to list %q: %v", dirPath, err)
+			errs++
+			return nil
+		}
+		for _, entry := range entries {
+			o, ok := entry.(*Object)
+			if !ok {
+				continue
+			}
+			if match, _ := path.Match(f.tempPattern, path.Base(o.remote)); !match {
+				continue
+			}
+			if fs.Config.DryRun {
+				fs.Logf(o, "Not removing temporary file as --dry-run")
+				continue
+			}
+			if err := o.Remove(); err != nil {
+				fs.Errorf(o, "CleanUp: failed to remove temporary file: %v", err)
+				errs++
+				continue
+			}
+			fs.Infof(o, "Removed temporary file")
+		}
+		return nil
+	})
 	if err != nil {
-		return errors.Wrapf(err, "DirMove Rename(%q,%q) failed", srcPath, dstPath)
+		return errors.Wrap(err, "CleanUp")
+	}
+	if errs != 0 {
+		return errors.Errorf("CleanUp: %d errors", errs)
 	}
 	return nil
 }
@@ -574,17 +3897,80 @@ func (o *Object) Hash(t hash.Type) (string, error) {
 }
 
 // Size returns the size of an object in bytes
+//
+// If the size was 0 in a listing it is read with SIZE the first time
+// as the listing may not have had it.  Implausibly big sizes are
+// returned as -1 for unknown.
 func (o *Object) Size() int64 {
+	if o.info.sizeUnknown {
+		err := o.refreshSize(context.Background())
+		if err != nil {
+			fs.Debugf(o, "Failed to read size: %v", err)
+		}
+		o.info.sizeUnknown = false
+	}
+	if o.info.Size > maxSize {
+		if !o.info.sizeWarned {
+			fs.Logf(o, "Ignoring implausible size %d from the server", o.info.Size)
+			o.info.sizeWarned = true
+		}
+		return -1
+	}
 	return int64(o.info.Size)
 }
 
 // ModTime returns the modification time of the object
+//
+// If modification times are supported, times from LIST lines are
+// replaced by the exact time from MDTM the first time they are asked
+// for.
 func (o *Object) ModTime() time.Time {
+	if o.info.roughTime && o.fs.Precision() != fs.ModTimeNotSupported {
+		o.info.roughTime = false
+		o.fs.readModTime(context.Background(), o.fs.fullPath(o.remote), o.info)
+	}
 	return o.info.ModTime
 }
 
-// SetModTime sets the modification time of the object
-func (o *Object) SetModTime(modTime time.Time) error {
+// SetModTime sets the modification time of the object
+//
+// This needs the server to support MFMT, otherwise it does nothing.
+func (o *Object) SetModTime(modTime time.Time) error {
+	if o.fs.readOnly {
+		return errorReadOnly
+	}
+	if !o.fs.canSetModTime() {
+		return nil
+	}
+	path := o.fs.fullPath(o.remote)
+	err := o.fs.run(context.Background(), func(c *ftp.ServerConn) error {
+		return o.fs.setFacts(c, path, modTime, "")
+	})
+	if err != nil {
+		return errors.Wrap(err, "SetModTime")
+	}
+	o.info.ModTime = modTime
+	if o.fs.Precision() != fs.ModTimeNotSupported {
+		// read the time back as the server may not store it exactly
+		if err := o.readMetaData(context.Background()); err != nil {
+			fs.Debugf(o, "Failed to read modification time back: %v", err)
+		}
+	}
+	return nil
+}
+
+// readMetaData reads the current size and modification time of the
+// object from the server
+func (o *Object) readMetaData(ctx context.Context) error {
+	info, err := o.fs.getInfo(ctx, o.fs.fullPath(o.remote))
+	if err != nil {
+		return err
+	}
+	if info.IsDir {
+		return fs.ErrorNotAFile
+	}
+	info.Name = o.remote
+	o.info = info
 	return nil
 }
 
@@ -593,126 +3979,939 @@ func (o *Object) Storable() bool {
 	return true
 }
 
+// refreshSize reads the current size of the object with SIZE if the
+// server supports it as the size from the listing may be out of date
+func (o *Object) refreshSize(ctx context.Context) error {
+	if !o.fs.serverFeatures.has("SIZE") {
+		return nil
+	}
+	path := o.fs.fullPath(o.remote)
+	var size int64
+	err := o.fs.pacer.Call(func() (bool, error) {
+		c, err := o.fs.getFtpConnection(ctx)
+		if err != nil {
+			return shouldRetry(err)
+		}
+		size, err = c.FileSize(path)
+		o.fs.putFtpConnection(&c, err)
+		return shouldRetry(err)
+	})
+	if err != nil {
+		return translateErrorFile(err)
+	}
+	o.info.Size = uint64(size)
+	o.info.sizeUnknown = false
+	return nil
+}
+
 // ftpReadCloser implements io.ReadCloser for FTP objects.
 type ftpReadCloser struct {
-	rc  io.ReadCloser
-	c   *ftp.ServerConn
-	f   *Fs
-	err error // errors found during read
+	rc       io.ReadCloser
+	c        *ftp.ServerConn // nil if a resume failed to reconnect
+	f        *Fs
+	o        *Object
+	err      error  // errors found during read
+	prot     string // PROT level of the transfer, for resuming it
+	offset   int64  // where in the file the read started
+	limit    int64  // bytes to read from offset if limited
+	limited  bool   // set if rc stops before the end of the file
+	expected int64  // bytes rc should return or -1 if unknown
+	read     int64  // bytes returned so far
+	eof      bool   // set when rc has returned io.EOF
+	resumes  int    // number of times the read has been resumed
 }
 
 // Read bytes into p
+//
+// If the data connection fails part way through the file it is read
+// again from where it got to on a new connection.
 func (f *ftpReadCloser) Read(p []byte) (n int, err error) {
 	n, err = f.rc.Read(p)
-	if err != nil && err != io.EOF {
+	f.read += int64(n)
+	if err != nil && f.resume(err) {
+		if n > 0 {
+			return n, nil
+		}
+		return f.Read(p)
+	}
+	if f.c == nil {
+		// a resume couldn't reconnect
+		err = f.err
+	}
+	if err == io.EOF {
+		f.eof = true
+	} else if err != nil {
 		f.err = err // store any errors for Close to examine
 	}
-	return
+	return n, err
+}
+
+// resume is called when reading fails with err, which is io.EOF at
+// the end of the data.  If the transfer broke before the end it
+// reopens the file on a new connection from where the read got to
+// and returns true.  This is done at most retries-1 times so the
+// transfer is tried retries times in all.
+//
+// It isn't done in ASCII mode as the number of bytes read doesn't
+// give the offset in the file.
+func (f *ftpReadCloser) resume(err error) bool {
+	if f.f.ascii || f.resumes+1 >= f.f.retries {
+		return false
+	}
+	if err == io.EOF {
+		if f.expected < 0 || f.read >= f.expected {
+			return false
+		}
+		// The data stopped early.  If the server says the
+		// transfer is complete the file is shorter than it was
+		// and Close checks the size, otherwise it broke.
+		closeErr := f.rc.Close()
+		if closeErr == nil {
+			return false
+		}
+		err = closeErr
+	} else {
+		_ = f.rc.Close()
+	}
+	if retry, _ := shouldRetry(err); !retry {
+		f.err = err
+		return false
+	}
+	f.resumes++
+	offset, limit := f.offset+f.read, int64(-1)
+	if f.limited {
+		limit = f.limit - f.read
+	}
+	fs.Debugf(f.o, "Resuming read at offset %d after: %v", offset, err)
+	f.f.closeFtpConnection(&f.c)
+	c, in, openErr := f.o.openFrom(context.Background(), f.prot, offset, limit)
+	if openErr != nil {
+		fs.Debugf(f.o, "Couldn't resume read: %v", openErr)
+		f.rc = ioutil.NopCloser(bytes.NewReader(nil))
+		f.err = err
+		return false
+	}
+	f.c, f.rc = c, in
+	return true
 }
 
 // Close the FTP reader and return the connection to the pool
 func (f *ftpReadCloser) Close() error {
 	err := f.rc.Close()
+	if f.c == nil {
+		// a resume couldn't reconnect
+		release(f.f.readTokens)
+		return f.err
+	}
 	// if errors while reading or closing, dump the connection
 	if err != nil || f.err != nil {
-		_ = f.c.Quit()
+		f.f.closeFtpConnection(&f.c)
 	} else {
 		f.f.putFtpConnection(&f.c, nil)
 	}
-	// mask the error if it was caused by a premature close
+	release(f.f.readTokens)
+	if f.eof && f.expected >= 0 && f.read != f.expected {
+		sizeErr := f.checkSize()
+		if sizeErr != nil {
+			if err != nil {
+				fs.Debugf(f.o, "Error closing transfer of the wrong size: %v", err)
+			}
+			return sizeErr
+		}
+	}
+	// Closing the data connection before the server has sent all
+	// of it makes the server complain with one of these, so mask
+	// them if that is what happened.  If the server stopped
+	// sending the data then the read wasn't complete so return
+	// the error.
+	partial := !f.eof || f.limited
+	if err != nil && f.f.tolerantClose && isMissingTransferReply(err) && (partial || f.expected >= 0) {
+		// With tolerant_close a transfer whose data was all
+		// read is complete even if the server didn't say so
+		fs.Debugf(f.o, "Assuming transfer complete after reading %d bytes: %v", f.read, err)
+		return nil
+	}
 	switch errX := err.(type) {
 	case *textproto.Error:
 		switch errX.Code {
 		case ftp.StatusTransfertAborted, ftp.StatusFileUnavailable:
-			err = nil
+			if partial {
+				err = nil
+			}
 		}
 	}
 	return err
 }
 
+// checkSize is called when the number of bytes read to the end
+// doesn't match the size expected.  Reads to the end of the file
+// read the metadata of the object again in case the file has changed
+// since it was listed.  It returns an error if too few bytes were
+// read, or too many if the size could be checked.
+func (f *ftpReadCloser) checkSize() error {
+	expected, checked := f.expected, false
+	if !f.limited {
+		if err := f.o.readMetaData(context.Background()); err != nil {
+			fs.Debugf(f.o, "Couldn't read size to check transfer: %v", err)
+		} else {
+			expected, checked = f.o.Size()-f.offset, true
+		}
+	}
+	if f.read < expected {
+		return errors.Errorf("transfer truncated: read %d bytes, expecting %d", f.read, expected)
+	}
+	if f.read > expected && checked {
+		return errors.Errorf("transfer too long: read %d bytes, expecting %d", f.read, expected)
+	}
+	return nil
+}
+
 // Open an object for read
 func (o *Object) Open(options ...fs.OpenOption) (rc io.ReadCloser, err error) {
 	// defer fs.Trace(o, "")("rc=%v, err=%v", &rc, &err)
-	path := path.Join(o.fs.root, o.remote)
-	var offset, limit int64
+	ctx := context.Background()
+	// limit is the number of bytes to read or -1 to read to the end
+	var offset, limit int64 = 0, -1
 	for _, option := range options {
 		switch x := option.(type) {
+		case *DataProtectionOption:
+			// applied to the connection below
 		case *fs.SeekOption:
-			offset, limit = x.Offset, 0
+			offset, limit = x.Offset, -1
 		case *fs.RangeOption:
+			if x.Start < 0 {
+				// fetching from the end needs the current size
+				if err := o.readMetaData(ctx); err != nil {
+					fs.Debugf(o, "Using size from listing as reading it failed: %v", err)
+				}
+			}
 			offset, limit = x.Decode(o.Size())
+			if limit < 0 {
+				limit = 0
+			}
+			if x.Start < 0 || x.End < 0 {
+				// Decode returns 0 for open ended ranges
+				limit = -1
+			}
+			if offset < 0 {
+				offset = 0
+			}
 		default:
 			if option.Mandatory() {
 				fs.Logf(o, "Unsupported mandatory option: %v", option)
 			}
 		}
 	}
-	c, err := o.fs.getFtpConnection()
+	if limit == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	prot, err := o.fs.transferProtection(options)
 	if err != nil {
 		return nil, errors.Wrap(err, "open")
 	}
-	fd, err := c.RetrFrom(path, uint64(offset))
+	// the reader holds its connection until it is closed
+	err = acquire(ctx, o.fs.readTokens)
 	if err != nil {
-		o.fs.putFtpConnection(&c, err)
 		return nil, errors.Wrap(err, "open")
 	}
-	rc = &ftpReadCloser{rc: readers.NewLimitedReadCloser(fd, limit), c: c, f: o.fs}
+	c, in, err := o.openFrom(ctx, prot, offset, limit)
+	if err != nil {
+		release(o.fs.readTokens)
+		return nil, errors.Wrap(err, "open")
+	}
+	// The number of bytes to expect is unknown in ASCII mode as
+	// the line endings may change
+	expected := int64(-1)
+	if size := o.Size(); size >= 0 && !o.fs.ascii {
+		expected = size - offset
+		if expected < 0 {
+			expected = 0
+		}
+		if limit > 0 && limit < expected {
+			expected = limit
+		}
+	}
+	rc = &ftpReadCloser{
+		rc:       in,
+		c:        c,
+		f:        o.fs,
+		o:        o,
+		prot:     prot,
+		offset:   offset,
+		limit:    limit,
+		limited:  limit > 0,
+		expected: expected,
+	}
 	return rc, nil
 }
 
+// openFrom starts reading the object from offset with PROT level
+// prot on a pooled connection, reading limit bytes if it is > 0 or
+// to the end otherwise.  It returns the connection, which must be
+// returned to the pool when the reader is closed.
+func (o *Object) openFrom(ctx context.Context, prot string, offset, limit int64) (c *ftp.ServerConn, in io.ReadCloser, err error) {
+	path := o.fs.fullPath(o.remote)
+	var fd *ftp.Response
+	err = o.fs.pacer.Call(func() (bool, error) {
+		c, err = o.fs.getFtpConnection(ctx)
+		if err != nil {
+			return shouldRetry(err)
+		}
+		err = o.fs.setTransferType(c)
+		if err == nil {
+			err = o.fs.setTransferProtection(c, prot)
+		}
+		if err == nil {
+			fd, err = c.RetrFrom(path, uint64(offset))
+		}
+		if err != nil && offset > 0 && isNotImplemented(err) {
+			fs.Debugf(o, "Server doesn't support REST, reading from the start: %v", err)
+			fd, err = retrSkip(c, path, offset)
+		}
+		if err != nil {
+			o.fs.putFtpConnection(&c, err)
+		}
+		return shouldRetry(err)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	in = fd
+	if limit > 0 {
+		in = readers.NewLimitedReadCloser(fd, limit)
+	}
+	if o.fs.ascii && !o.fs.asciiCRLF {
+		in = struct {
+			io.Reader
+			io.Closer
+		}{o.fs.convertLineEndings(in, false), in}
+	}
+	if o.fs.bwLimit != nil {
+		in = struct {
+			io.Reader
+			io.Closer
+		}{o.fs.limitBandwidth(in), in}
+	}
+	return c, in, nil
+}
+
+// bwLimitBurst is the most bytes a transfer limited by bandwidth_limit
+// reads at once
+const bwLimitBurst = 64 * 1024
+
+// newBwLimiter makes a limiter for bandwidth bytes/s
+func newBwLimiter(bandwidth fs.SizeSuffix) *rate.Limiter {
+	limiter := rate.NewLimiter(rate.Limit(bandwidth), bwLimitBurst)
+	// empty the bucket so transfers start at the limit
+	_ = limiter.WaitN(context.Background(), bwLimitBurst)
+	return limiter
+}
+
+// bwLimitReader reads from in no faster than limiter allows
+type bwLimitReader struct {
+	in      io.Reader
+	limiter *rate.Limiter
+}
+
+// Read bytes into p waiting for the limiter after reading them
+func (r *bwLimitReader) Read(p []byte) (n int, err error) {
+	if len(p) > bwLimitBurst {
+		p = p[:bwLimitBurst]
+	}
+	n, err = r.in.Read(p)
+	if n > 0 {
+		_ = r.limiter.WaitN(context.Background(), n)
+	}
+	return n, err
+}
+
+// limitBandwidth returns a reader for in limited by bandwidth_limit
+// if it is set, sharing the limit with the other transfers of f
+func (f *Fs) limitBandwidth(in io.Reader) io.Reader {
+	if f.bwLimit == nil {
+		return in
+	}
+	return &bwLimitReader{in: in, limiter: f.bwLimit}
+}
+
+// crlfReader converts the line endings of the text read from in.
+// With toCRLF set bare LFs are turned into CRLFs, otherwise CRLFs are
+// turned into LFs.
+type crlfReader struct {
+	in     io.Reader
+	toCRLF bool
+	chunk  [32 * 1024]byte // data read from in
+	buf    []byte          // converted data
+	out    []byte          // the part of buf not returned yet
+	cr     bool            // set if the last byte read was a CR
+	err    error           // error from in to return once out is empty
+}
+
+// Read converted bytes into p
+func (r *crlfReader) Read(p []byte) (n int, err error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			// a CR held back at the end isn't part of a CRLF
+			if r.cr && !r.toCRLF {
+				r.cr = false
+				r.out = append(r.out, '\r')
+				break
+			}
+			return 0, r.err
+		}
+		n, r.err = r.in.Read(r.chunk[:])
+		r.convert(r.chunk[:n])
+	}
+	n = copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// convert the line endings of data into r.out, which must be empty
+func (r *crlfReader) convert(data []byte) {
+	out := r.buf[:0]
+	for _, b := range data {
+		if r.toCRLF {
+			if b == '\n' && !r.cr {
+				out = append(out, '\r')
+			}
+			out = append(out, b)
+			r.cr = b == '\r'
+			continue
+		}
+		if r.cr {
+			r.cr = false
+			if b == '\n' {
+				out = append(out, b)
+				continue
+			}
+			out = append(out, '\r')
+		}
+		if b == '\r' {
+			r.cr = true
+			continue
+		}
+		out = append(out, b)
+	}
+	r.buf, r.out = out, out
+}
+
+// convertLineEndings returns a reader for the text in which converts
+// its LF line endings to the CRLF sent in ASCII mode if toCRLF is
+// set, or back again if not.  The text is left alone unless ascii is
+// set and ascii_line_ending is lf.
+func (f *Fs) convertLineEndings(in io.Reader, toCRLF bool) io.Reader {
+	if !f.ascii || f.asciiCRLF {
+		return in
+	}
+	return &crlfReader{in: in, toCRLF: toCRLF}
+}
+
+// retrSkip fetches path with RETR then reads and discards offset
+// bytes, for servers which don't support REST
+func retrSkip(c *ftp.ServerConn, path string, offset int64) (*ftp.Response, error) {
+	fd, err := c.Retr(path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.CopyN(ioutil.Discard, fd, offset)
+	if err != nil && err != io.EOF {
+		_ = fd.Close()
+		return nil, err
+	}
+	return fd, nil
+}
+
 // Update the already existing object
 //
-// Copy the reader into the object updating modTime and size
+// Copy the reader into the object updating modTime and size.  If the
+// size of src is known it is declared to the server with ALLO first
+// so servers short of space can refuse the upload straight away.
 //
 // The new object may have been created if an error is returned
 func (o *Object) Update(in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (err error) {
 	// defer fs.Trace(o, "src=%v", src)("err=%v", &err)
-	path := path.Join(o.fs.root, o.remote)
+	if o.fs.readOnly {
+		return errorReadOnly
+	}
+	path := o.fs.fullPath(o.remote)
+	ctx := context.Background()
+	// With atomic_upload the data is stored under a temporary name
+	// and renamed into place when it is complete
+	storPath := path
+	if o.fs.atomicUpload {
+		storPath = tempName(path)
+	}
 	// remove the file if upload failed
 	remove := func() {
-		removeErr := o.Remove()
+		removeErr := o.fs.run(ctx, func(c *ftp.ServerConn) error {
+			return c.Delete(storPath)
+		})
 		if removeErr != nil {
 			fs.Debugf(o, "Failed to remove: %v", removeErr)
 		} else {
 			fs.Debugf(o, "Removed after failed upload: %v", err)
 		}
 	}
-	c, err := o.fs.getFtpConnection()
+	// The upload can't be retried once the input has been read
+	// unless it can be seeked.  If it can a failed upload is resumed
+	// from the end of the partial file on the server, except in
+	// ASCII mode where the sizes on the server don't match the input.
+	seeker, canResume := in.(io.Seeker)
+	canResume = canResume && !o.fs.ascii
+	counter := readers.NewCountingReader(in)
+	in = counter
+	prot, err := o.fs.transferProtection(options)
 	if err != nil {
 		return errors.Wrap(err, "Update")
 	}
-	err = c.Stor(path, in)
+	stored, resuming, unconfirmed := false, false, false
+	defer func() {
+		if err != nil && stored {
+			// the file on the server may have changed or gone
+			if metaErr := o.readMetaData(ctx); metaErr != nil {
+				fs.Debugf(o, "Failed to read metadata after failed upload: %v", metaErr)
+			}
+		}
+	}()
+	if o.fs.useChunks(src.Size()) {
+		stored = true
+		err = o.fs.chunkedStor(ctx, storPath, in, src.Size(), prot)
+	} else {
+		err = o.fs.pacer.Call(func() (bool, error) {
+			c, err := o.fs.getFtpConnection(ctx)
+			if err != nil {
+				return shouldRetry(err)
+			}
+			err = o.fs.setTransferProtection(c, prot)
+			if err != nil {
+				o.fs.putFtpConnection(&c, err)
+				return shouldRetry(err)
+			}
+			var offset int64
+			if resuming {
+				offset, err = o.fs.resumeOffset(c, storPath, seeker)
+				if err != nil {
+					o.fs.putFtpConnection(&c, err)
+					return false, err
+				}
+			}
+			if size := src.Size(); size >= 0 && offset == 0 {
+				o.fs.allocate(c, size)
+			}
+			stored = true
+			err = o.fs.stor(c, storPath, in, offset)
+			if err != nil && o.fs.tolerantClose && isMissingTransferReply(err) {
+				// The data was all sent as errors sending it
+				// are returned first, so check the size below
+				// rather than failing
+				fs.Debugf(o, "Assuming upload complete: %v", err)
+				o.fs.closeFtpConnection(&c)
+				unconfirmed = true
+				return false, nil
+			}
+			if err != nil {
+				o.fs.putFtpConnection(&c, err)
+				retry, _ := shouldRetry(err)
+				resuming = canResume && retry
+				return resuming, err
+			}
+			o.fs.putFtpConnection(&c, nil)
+			return false, nil
+		})
+	}
 	if err != nil {
-		_ = c.Quit()
+		if !stored {
+			return errors.Wrap(err, "Update")
+		}
 		remove()
-		return errors.Wrap(err, "update stor")
+		return errors.Wrap(translatePermissionDenied(err), "update stor")
+	}
+	if counter.BytesRead() == 0 {
+		err = o.fs.checkEmptyUpload(ctx, storPath)
+		if err != nil {
+			remove()
+			return errors.Wrap(err, "update")
+		}
+	}
+	if o.fs.verifyUpload || unconfirmed {
+		err = o.fs.checkUpload(ctx, storPath, src.Size(), counter, resuming)
+		if err != nil {
+			remove()
+			return err
+		}
+	}
+	if storPath != path {
+		err = o.fs.run(ctx, func(c *ftp.ServerConn) error {
+			return renameOver(c, storPath, path)
+		})
+		if err != nil {
+			remove()
+			return errors.Wrap(err, "update rename")
+		}
+	}
+	var modTime time.Time
+	if o.fs.canSetModTime() {
+		modTime = src.ModTime()
+	}
+	if o.fs.chmod != "" || !modTime.IsZero() {
+		// the data is in place so don't fail the upload for this
+		err = o.fs.run(ctx, func(c *ftp.ServerConn) error {
+			return o.fs.setFacts(c, path, modTime, o.fs.chmod)
+		})
+		if err != nil {
+			fs.Errorf(o, "Failed to set modification time or permissions: %v", err)
+		}
 	}
-	o.fs.putFtpConnection(&c, nil)
-	o.info, err = o.fs.getInfo(path)
+	err = o.readMetaData(ctx)
 	if err != nil {
 		return errors.Wrap(err, "update getinfo")
 	}
 	return nil
 }
 
+// allocate declares the size of the upload about to be made to the
+// server with ALLO.  Servers which don't need or support it may
+// reject it so errors are ignored.
+func (f *Fs) allocate(c *ftp.ServerConn, size int64) {
+	code, message, err := c.Quote("ALLO %d", size)
+	if err == nil && (code < 200 || code >= 300) {
+		err = &textproto.Error{Code: code, Msg: message}
+	}
+	if err != nil {
+		fs.Debugf(f, "Ignoring ALLO failure: %v", err)
+	}
+}
+
+// useChunks returns true if an upload of size bytes should be split
+// into segments with chunkedStor.  This needs SITE CONCAT to join
+// them and isn't done in ASCII mode as the line endings could be
+// split between segments.
+func (f *Fs) useChunks(size int64) bool {
+	if f.chunkUpload <= 0 || size <= int64(f.chunkUpload) || f.ascii {
+		return false
+	}
+	if !f.serverFeatures.has("SITE CONCAT") {
+		fs.Debugf(f, "Not uploading in segments as the server doesn't support SITE CONCAT")
+		return false
+	}
+	return true
+}
+
+// chunkedStor uploads size bytes from in to path in segments of
+// chunk_upload bytes.  The segments are read into memory and stored
+// under temporary names on up to concurrency connections at once,
+// then joined into path with SITE CONCAT.  The segments are removed
+// afterwards whether or not this worked.
+func (f *Fs) chunkedStor(ctx context.Context, path string, in io.Reader, size int64, prot string) (err error) {
+	workers := f.concurrency
+	if workers <= 0 {
+		workers = fs.Config.Transfers
+	}
+	var (
+		parts   []string
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		storErr error
+		slots   = make(chan struct{}, workers)
+		chunk   = int64(f.chunkUpload)
+	)
+	setError := func(err error) {
+		mu.Lock()
+		if storErr == nil {
+			storErr = err
+		}
+		mu.Unlock()
+	}
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return storErr != nil
+	}
+	defer func() {
+		for _, part := range parts {
+			removeErr := f.run(ctx, func(c *ftp.ServerConn) error {
+				return c.Delete(part)
+			})
+			if removeErr != nil && translateErrorFile(removeErr) != fs.ErrorObjectNotFound {
+				fs.Debugf(f, "Failed to remove segment %q: %v", part, removeErr)
+			}
+		}
+	}()
+	for offset := int64(0); offset < size && !failed(); offset += chunk {
+		n := chunk
+		if size-offset < n {
+			n = size - offset
+		}
+		buf := make([]byte, n)
+		_, err = io.ReadFull(in, buf)
+		if err != nil {
+			setError(errors.Wrap(err, "read segment"))
+			break
+		}
+		part := tempName(path)
+		parts = append(parts, part)
+		segment := len(parts)
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			fs.Debugf(f, "Uploading segment %d of %q", segment, path)
+			err := f.storSegment(ctx, part, buf, prot)
+			if err != nil {
+				setError(errors.Wrapf(err, "segment %q", part))
+			}
+		}()
+	}
+	wg.Wait()
+	if storErr != nil {
+		return storErr
+	}
+	return f.run(ctx, func(c *ftp.ServerConn) error {
+		return siteConcat(c, path, parts)
+	})
+}
+
+// storSegment stores data at path, retrying if the connection fails
+func (f *Fs) storSegment(ctx context.Context, path string, data []byte, prot string) error {
+	return f.pacer.Call(func() (bool, error) {
+		c, err := f.getFtpConnection(ctx)
+		if err != nil {
+			return shouldRetry(err)
+		}
+		err = f.setTransferProtection(c, prot)
+		if err != nil {
+			f.putFtpConnection(&c, err)
+			return shouldRetry(err)
+		}
+		err = f.stor(c, path, bytes.NewReader(data), 0)
+		f.putFtpConnection(&c, err)
+		return shouldRetry(err)
+	})
+}
+
+// siteConcat joins parts in order into path with SITE CONCAT, which
+// takes the destination then the sources each in double quotes with
+// any double quotes in them doubled.
+func siteConcat(c *ftp.ServerConn, path string, parts []string) error {
+	quote := func(p string) string {
+		return `"` + strings.Replace(p, `"`, `""`, -1) + `"`
+	}
+	args := []string{quote(path)}
+	for _, part := range parts {
+		args = append(args, quote(part))
+	}
+	code, message, err := c.Quote("SITE CONCAT %s", strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	if code != ftp.StatusRequestedFileActionOK {
+		return &textproto.Error{Code: code, Msg: message}
+	}
+	return nil
+}
+
+// checkEmptyUpload checks the empty file just stored at path exists.
+// Some servers only create a file when data arrives for it, so if it
+// is missing it is stored again with APPE which they create when it
+// is opened.
+func (f *Fs) checkEmptyUpload(ctx context.Context, path string) error {
+	_, err := f.getInfo(ctx, path)
+	if err != fs.ErrorObjectNotFound {
+		return err
+	}
+	fs.Debugf(f, "Empty file %q wasn't created so appending to it", path)
+	err = f.run(ctx, func(c *ftp.ServerConn) error {
+		return c.Append(path, bytes.NewReader(nil))
+	})
+	if err != nil {
+		return errors.Wrap(err, "empty file")
+	}
+	_, err = f.getInfo(ctx, path)
+	if err == fs.ErrorObjectNotFound {
+		return errors.New("server didn't create the empty file")
+	}
+	return err
+}
+
+// defaultTempPattern matches the names made by tempName
+const defaultTempPattern = "*.rclone-tmp-*"
+
+// checkUpload checks the size of the file stored at path on the
+// server matches the size of the source, or the number of bytes read
+// by counter if that isn't known, returning a retryable error if not.
+//
+// The check is skipped if the size can't be known, which is the case
+// in ASCII mode as the line endings may be changed, and for sources of
+// unknown size which were resumed as counter includes the retries.
+func (f *Fs) checkUpload(ctx context.Context, path string, want int64, counter *readers.CountingReader, resumed bool) error {
+	if want < 0 && !resumed {
+		want = int64(counter.BytesRead())
+	}
+	if want < 0 || f.ascii {
+		fs.Debugf(f, "Can't verify upload of %q as its size isn't known", path)
+		return nil
+	}
+	var size int64
+	var err error
+	if f.serverFeatures.has("SIZE") {
+		err = f.run(ctx, func(c *ftp.ServerConn) error {
+			var sizeErr error
+			size, sizeErr = c.FileSize(path)
+			return sizeErr
+		})
+	} else {
+		var info *FileInfo
+		info, err = f.getInfo(ctx, path)
+		if err == nil {
+			size = int64(info.Size)
+		}
+	}
+	if err != nil {
+		return errors.Wrap(err, "verify upload")
+	}
+	if size != want {
+		return fserrors.RetryErrorf("verify upload: %d bytes were sent but the server has %d", want, size)
+	}
+	return nil
+}
+
+// tempName returns a unique temporary name to upload path to
+func tempName(path string) string {
+	var random [4]byte
+	_, _ = rand.Read(random[:])
+	return fmt.Sprintf("%s.rclone-tmp-%x", path, random)
+}
+
+// renameOver renames from to to replacing to if it exists.  Some
+// servers won't rename over an existing file so if the rename fails
+// to is deleted and the rename tried again.
+func renameOver(c *ftp.ServerConn, from, to string) error {
+	err := c.Rename(from, to)
+	if err == nil || translateErrorFile(err) != fs.ErrorObjectNotFound {
+		return err
+	}
+	if c.Delete(to) != nil {
+		return err
+	}
+	return c.Rename(from, to)
+}
+
+// siteChmod sets the permissions of path to the octal mode with SITE
+// CHMOD.  Servers which don't support it are skipped.
+func (f *Fs) siteChmod(c *ftp.ServerConn, path, mode string) error {
+	code, message, err := c.Quote("SITE CHMOD %s %s", mode, path)
+	if err != nil {
+		return err
+	}
+	err = &textproto.Error{Code: code, Msg: message}
+	switch {
+	case code == ftp.StatusCommandOK:
+		return nil
+	case isNotImplemented(err):
+		fs.Debugf(f, "Not setting permissions as server doesn't support SITE CHMOD: %v", err)
+		return nil
+	}
+	return err
+}
+
+// canSetModTime returns true if the server can set modification
+// times, with MFMT or MFF
+func (f *Fs) canSetModTime() bool {
+	return f.serverFeatures.has("MFMT") || f.serverFeatures.hasFact("MFF", "modify")
+}
+
+// setFacts sets the modification time and octal permissions of the
+// file at path, leaving out either if it is zero or "".
+//
+// Servers which support MFF with the facts needed set both with one
+// command, otherwise the permissions are set with SITE CHMOD and the
+// modification time with MFMT.
+func (f *Fs) setFacts(c *ftp.ServerConn, path string, modTime time.Time, mode string) error {
+	var facts string
+	if !modTime.IsZero() && f.serverFeatures.hasFact("MFF", "modify") {
+		facts += "modify=" + modTime.In(time.UTC).Format("20060102150405") + ";"
+		modTime = time.Time{}
+	}
+	if mode != "" && f.serverFeatures.hasFact("MFF", "UNIX.mode") {
+		facts += "UNIX.mode=" + mode + ";"
+		mode = ""
+	}
+	if facts != "" {
+		code, message, err := c.Quote("MFF %s %s", facts, path)
+		if err != nil {
+			return errors.Wrap(err, "MFF")
+		}
+		if code != ftp.StatusFile {
+			return errors.Wrap(&textproto.Error{Code: code, Msg: message}, "MFF")
+		}
+	}
+	if mode != "" {
+		err := f.siteChmod(c, path, mode)
+		if err != nil {
+			return errors.Wrap(err, "chmod")
+		}
+	}
+	if !modTime.IsZero() {
+		err := c.SetTime(path, modTime)
+		if err != nil {
+			return errors.Wrap(err, "set modtime")
+		}
+	}
+	return nil
+}
+
+// resumeOffset finds how much of a failed upload to path reached the
+// server and seeks in to match.  If the size can't be read the upload
+// starts again from the beginning.
+func (f *Fs) resumeOffset(c *ftp.ServerConn, path string, in io.Seeker) (int64, error) {
+	offset, err := c.FileSize(path)
+	if err != nil {
+		fs.Debugf(f, "Restarting upload of %q as SIZE failed: %v", path, err)
+		offset = 0
+	}
+	_, err = in.Seek(offset, os.SEEK_SET)
+	return offset, err
+}
+
+// stor uploads in to path, continuing a partial upload from offset
+// with REST or if the server doesn't support that APPE
+func (f *Fs) stor(c *ftp.ServerConn, path string, in io.Reader, offset int64) error {
+	if err := f.setTransferType(c); err != nil {
+		return err
+	}
+	in = f.limitBandwidth(f.convertLineEndings(in, true))
+	if offset == 0 {
+		return c.Stor(path, in)
+	}
+	fs.Debugf(f, "Resuming upload of %q from %d", path, offset)
+	if f.serverFeatures.has("REST STREAM") {
+		return c.StorFrom(path, in, uint64(offset))
+	}
+	return c.Append(path, in)
+}
+
 // Remove an object
 func (o *Object) Remove() (err error) {
 	// defer fs.Trace(o, "")("err=%v", &err)
-	path := path.Join(o.fs.root, o.remote)
+	if o.fs.readOnly {
+		return errorReadOnly
+	}
+	path := o.fs.fullPath(o.remote)
 	// Check if it's a directory or a file
-	info, err := o.fs.getInfo(path)
+	ctx := context.Background()
+	info, err := o.fs.getInfo(ctx, path)
 	if err != nil {
 		return err
 	}
 	if info.IsDir {
 		err = o.fs.Rmdir(o.remote)
 	} else {
-		c, err := o.fs.getFtpConnection()
-		if err != nil {
-			return errors.Wrap(err, "Remove")
-		}
-		err = c.Delete(path)
-		o.fs.putFtpConnection(&c, err)
+		err = o.fs.run(ctx, func(c *ftp.ServerConn) error {
+			return c.Delete(path)
+		})
+		err = translateErrorFile(err)
 	}
 	return err
 }
@@ -720,8 +4919,11 @@ func (o *Object) Remove() (err error) {
 // Check the interfaces are satisfied
 var (
 	_ fs.Fs          = &Fs{}
+	_ fs.Copier      = &Fs{}
 	_ fs.Mover       = &Fs{}
 	_ fs.DirMover    = &Fs{}
 	_ fs.PutStreamer = &Fs{}
+	_ fs.CleanUpper  = &Fs{}
+	_ fs.ListRer     = &Fs{}
 	_ fs.Object      = &Object{}
 )
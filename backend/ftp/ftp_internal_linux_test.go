@@ -0,0 +1,72 @@
+package ftp
+
+import (
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// keepAlive reads whether TCP keep-alives are on for conn and how
+// many seconds it must be idle before they are sent
+func keepAlive(t *testing.T, conn net.Conn) (on, idle int) {
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	require.NoError(t, err)
+	var errs [2]error
+	require.NoError(t, raw.Control(func(fd uintptr) {
+		on, errs[0] = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		idle, errs[1] = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+	}))
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+	return on, idle
+}
+
+func TestTCPKeepAlive(t *testing.T) {
+	srv, f, tidy := prepare(t, map[string]string{"tcp_keepalive": "7s"})
+	defer tidy()
+	srv.putFile("/file.txt", "hello", time.Now())
+	assert.Equal(t, 7*time.Second, f.keepAlive)
+
+	// catch the connections made by the default dialer
+	var mu sync.Mutex
+	var conns []net.Conn
+	f.SetDialFunc(func(network, address string) (net.Conn, error) {
+		conn, err := f.dialDirect(network, address)
+		if err == nil {
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+		return conn, err
+	})
+	defer func() { _ = f.drainPool() }()
+	_, err := f.List("")
+	require.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotEmpty(t, conns)
+	on, idle := keepAlive(t, conns[0])
+	assert.NotEqual(t, 0, on)
+	assert.Equal(t, 7, idle)
+
+	// 0 turns them off
+	f2, err := newTestFs(srv, "", map[string]string{"tcp_keepalive": "0"})
+	require.NoError(t, err)
+	defer func() { _ = f2.drainPool() }()
+	conn, err := f2.dialDirect("tcp", net.JoinHostPort(srv.host, srv.port))
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	on, _ = keepAlive(t, conn)
+	assert.Equal(t, 0, on)
+
+	_, err = newTestFs(srv, "", map[string]string{"tcp_keepalive": "soon"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "bad tcp_keepalive")
+}
@@ -0,0 +1,132 @@
+// Run the generic fstests against the in-process test server
+
+package ftp
+
+import (
+	"testing"
+
+	"github.com/ncw/rclone/fs"
+	"github.com/ncw/rclone/fs/config/obscure"
+	"github.com/ncw/rclone/fstest/fstests"
+)
+
+// fsTests are the generic tests in the order they must be run in,
+// the same as in ftp_test.go
+var fsTests = []struct {
+	name string
+	fn   func(t *testing.T)
+}{
+	{"Init", fstests.TestInit},
+	{"FsString", fstests.TestFsString},
+	{"FsName", fstests.TestFsName},
+	{"FsRoot", fstests.TestFsRoot},
+	{"FsRmdirEmpty", fstests.TestFsRmdirEmpty},
+	{"FsRmdirNotFound", fstests.TestFsRmdirNotFound},
+	{"FsMkdir", fstests.TestFsMkdir},
+	{"FsMkdirRmdirSubdir", fstests.TestFsMkdirRmdirSubdir},
+	{"FsListEmpty", fstests.TestFsListEmpty},
+	{"FsListDirEmpty", fstests.TestFsListDirEmpty},
+	{"FsListRDirEmpty", fstests.TestFsListRDirEmpty},
+	{"FsNewObjectNotFound", fstests.TestFsNewObjectNotFound},
+	{"FsPutFile1", fstests.TestFsPutFile1},
+	{"FsPutError", fstests.TestFsPutError},
+	{"FsPutFile2", fstests.TestFsPutFile2},
+	{"FsUpdateFile1", fstests.TestFsUpdateFile1},
+	{"FsListDirFile2", fstests.TestFsListDirFile2},
+	{"FsListRDirFile2", fstests.TestFsListRDirFile2},
+	{"FsListDirRoot", fstests.TestFsListDirRoot},
+	{"FsListRDirRoot", fstests.TestFsListRDirRoot},
+	{"FsListSubdir", fstests.TestFsListSubdir},
+	{"FsListRSubdir", fstests.TestFsListRSubdir},
+	{"FsListLevel2", fstests.TestFsListLevel2},
+	{"FsListRLevel2", fstests.TestFsListRLevel2},
+	{"FsListFile1", fstests.TestFsListFile1},
+	{"FsNewObject", fstests.TestFsNewObject},
+	{"FsListFile1and2", fstests.TestFsListFile1and2},
+	{"FsNewObjectDir", fstests.TestFsNewObjectDir},
+	{"FsCopy", fstests.TestFsCopy},
+	{"FsMove", fstests.TestFsMove},
+	{"FsDirMove", fstests.TestFsDirMove},
+	{"FsRmdirFull", fstests.TestFsRmdirFull},
+	{"FsPrecision", fstests.TestFsPrecision},
+	{"FsDirChangeNotify", fstests.TestFsDirChangeNotify},
+	{"ObjectString", fstests.TestObjectString},
+	{"ObjectFs", fstests.TestObjectFs},
+	{"ObjectRemote", fstests.TestObjectRemote},
+	{"ObjectHashes", fstests.TestObjectHashes},
+	{"ObjectModTime", fstests.TestObjectModTime},
+	{"ObjectMimeType", fstests.TestObjectMimeType},
+	{"ObjectSetModTime", fstests.TestObjectSetModTime},
+	{"ObjectSize", fstests.TestObjectSize},
+	{"ObjectOpen", fstests.TestObjectOpen},
+	{"ObjectOpenSeek", fstests.TestObjectOpenSeek},
+	{"ObjectOpenRange", fstests.TestObjectOpenRange},
+	{"ObjectPartialRead", fstests.TestObjectPartialRead},
+	{"ObjectUpdate", fstests.TestObjectUpdate},
+	{"ObjectStorable", fstests.TestObjectStorable},
+	{"FsIsFile", fstests.TestFsIsFile},
+	{"FsIsFileNotFound", fstests.TestFsIsFileNotFound},
+	{"ObjectRemove", fstests.TestObjectRemove},
+	{"FsPutStream", fstests.TestFsPutStream},
+	{"ObjectPurge", fstests.TestObjectPurge},
+	{"Finalise", fstests.TestFinalise},
+}
+
+// TestIntegration runs the generic tests against a testServer,
+// without TLS and with explicit and implicit TLS, so they can be run
+// without a real FTP server.  ftp_test.go runs them against the
+// TestFTP remote if one is configured.
+func TestIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+	for _, test := range []struct {
+		name     string
+		tls      bool
+		implicit bool
+	}{
+		{"Plain", false, false},
+		{"ExplicitTLS", true, false},
+		{"ImplicitTLS", true, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var srv *testServer
+			if test.tls {
+				srv = newTestTLSServer(t, test.implicit)
+			} else {
+				srv = newTestServer(t)
+			}
+			defer srv.Close()
+
+			name := "TestFTPMock" + test.name
+			extra := []fstests.ExtraConfigItem{
+				{Name: name, Key: "type", Value: "ftp"},
+				{Name: name, Key: "host", Value: srv.host},
+				{Name: name, Key: "port", Value: srv.port},
+				{Name: name, Key: "user", Value: testUser},
+				{Name: name, Key: "pass", Value: obscure.MustObscure(testPass)},
+			}
+			if test.tls {
+				extra = append(extra, fstests.ExtraConfigItem{Name: name, Key: "no_check_certificate", Value: "true"})
+				if test.implicit {
+					extra = append(extra, fstests.ExtraConfigItem{Name: name, Key: "tls", Value: "true"})
+				} else {
+					extra = append(extra, fstests.ExtraConfigItem{Name: name, Key: "explicit_tls", Value: "true"})
+				}
+			}
+			oldRemoteName, oldNilObject, oldExtraConfig := fstests.RemoteName, fstests.NilObject, fstests.ExtraConfig
+			defer func() {
+				fstests.RemoteName, fstests.NilObject, fstests.ExtraConfig = oldRemoteName, oldNilObject, oldExtraConfig
+			}()
+			fstests.RemoteName = name + ":"
+			fstests.NilObject = fs.Object((*Object)(nil))
+			fstests.ExtraConfig = extra
+
+			for _, fsTest := range fsTests {
+				if !t.Run(fsTest.name, fsTest.fn) && fsTest.name == "Init" {
+					return
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,1436 @@
+// An in memory FTP server for exercising the backend in tests
+
+package ftp
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ncw/rclone/fs/config"
+	"github.com/ncw/rclone/fs/config/obscure"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testUser = "rclone"
+	testPass = "secret"
+)
+
+// testHook can override the handling of a command - return true if
+// the command was handled
+type testHook func(s *testSession, arg string) bool
+
+// testFile is a file or directory stored in the testServer
+type testFile struct {
+	isDir   bool
+	data    []byte
+	modTime time.Time
+	link    string // absolute path of the target if a symlink
+	mode    string // permissions set with SITE CHMOD
+}
+
+// testServer is a minimal FTP server keeping its files in memory
+type testServer struct {
+	t        *testing.T
+	listener net.Listener
+	host     string
+	port     string
+	wg       sync.WaitGroup
+
+	mu         sync.Mutex
+	files      map[string]*testFile // keyed on absolute path
+	features   []string             // lines to return from FEAT
+	hooks      map[string]testHook  // keyed on upper case command
+	commands   []string             // all the commands received
+	sessions   map[*testSession]struct{}
+	logins     int      // number of successful logins
+	busy       int      // number of connections to refuse with 421
+	clients    []string // remote addresses of all control and data connections
+	asciiXfers int      // number of RETR and STOR commands made in ASCII mode
+	relative   bool     // set to refuse absolute paths other than with CWD
+	noReplace  bool     // set to refuse to rename over an existing file
+	hideDots   bool     // set to leave dotfiles out of LIST unless -a is passed
+	stat       bool     // set to support STAT with a path
+	cwdListing bool     // set to refuse LIST and NLST with a path
+	pasvIP     string   // address to give in PASV replies if set
+	ignoreCase bool     // set to match existing paths case insensitively
+	banner     []string // lines of the greeting if set
+	welcome    []string // lines of the reply to a successful login if set
+
+	tlsConfig    *tls.Config // set if the server supports TLS
+	certPEM      []byte      // PEM encoded certificate of the server
+	requireReuse bool        // set to insist TLS data connections resume the session
+	dataResumed  []bool      // whether each TLS data connection resumed the session
+}
+
+// newTestServer starts a testServer listening on localhost
+func newTestServer(t *testing.T) *testServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	return startTestServer(t, listener, nil, nil)
+}
+
+// newTestTLSServer starts a testServer listening on localhost which
+// supports AUTH TLS, or if implicit is set only accepts TLS
+// connections.  The certificate is for names if set.
+func newTestTLSServer(t *testing.T, implicit bool, names ...string) *testServer {
+	tlsConfig, certPEM := testTLSConfig(t, names...)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	if implicit {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	return startTestServer(t, listener, tlsConfig, certPEM)
+}
+
+// testTLSConfig makes a server TLS config with a self signed
+// certificate for names, or 127.0.0.1 and localhost if not set,
+// returning it and the PEM encoded certificate
+func testTLSConfig(t *testing.T, names ...string) (*tls.Config, []byte) {
+	if len(names) == 0 {
+		names = []string{"127.0.0.1", "localhost"}
+	}
+	var ips []net.IP
+	var dnsNames []string
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			dnsNames = append(dnsNames, name)
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rclone test server"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           ips,
+		DNSNames:              dnsNames,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert := tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// testClientCert makes a self signed TLS client certificate returning
+// it and its private key PEM encoded together
+func testClientCert(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: testUser},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})) +
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+// startTestServer serves on listener using tlsConfig for AUTH TLS and
+// protected data connections if set
+func startTestServer(t *testing.T, listener net.Listener, tlsConfig *tls.Config, certPEM []byte) *testServer {
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+	srv := &testServer{
+		t:         t,
+		listener:  listener,
+		host:      host,
+		port:      port,
+		tlsConfig: tlsConfig,
+		certPEM:   certPEM,
+		files: map[string]*testFile{
+			"/": {isDir: true, modTime: time.Now()},
+		},
+		hooks:    map[string]testHook{},
+		sessions: map[*testSession]struct{}{},
+	}
+	srv.wg.Add(1)
+	go srv.serve()
+	return srv
+}
+
+// serve accepts control connections until the listener is closed
+func (srv *testServer) serve() {
+	defer srv.wg.Done()
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+		s := &testSession{
+			srv:  srv,
+			conn: conn,
+			tp:   textproto.NewConn(conn),
+			cwd:  "/",
+		}
+		srv.mu.Lock()
+		srv.sessions[s] = struct{}{}
+		srv.clients = append(srv.clients, conn.RemoteAddr().String())
+		srv.mu.Unlock()
+		srv.wg.Add(1)
+		go s.serve()
+	}
+}
+
+// Close stops the server and drops all the connections to it
+func (srv *testServer) Close() {
+	_ = srv.listener.Close()
+	srv.mu.Lock()
+	for s := range srv.sessions {
+		_ = s.conn.Close()
+	}
+	srv.mu.Unlock()
+	srv.wg.Wait()
+}
+
+// dropSessions closes all the control connections to the server
+// leaving it running
+func (srv *testServer) dropSessions() {
+	srv.closeSessions()
+	waitFor(srv.t, func() bool { return srv.openSessions() == 0 })
+}
+
+// closeSessions closes all the control connections to the server
+// without waiting for them to go
+func (srv *testServer) closeSessions() {
+	srv.mu.Lock()
+	for s := range srv.sessions {
+		_ = s.conn.Close()
+	}
+	srv.mu.Unlock()
+}
+
+// setHook installs a hook for cmd
+func (srv *testServer) setHook(cmd string, hook testHook) {
+	srv.mu.Lock()
+	srv.hooks[cmd] = hook
+	srv.mu.Unlock()
+}
+
+// refuseAbsolute returns true if the command should be refused as
+// it uses an absolute path and srv.relative is set
+func (srv *testServer) refuseAbsolute(cmd, arg string) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.relative && cmd != "CWD" && strings.HasPrefix(arg, "/")
+}
+
+// getHook returns the hook for cmd or nil
+func (srv *testServer) getHook(cmd string) testHook {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.hooks[cmd]
+}
+
+// setFeatures sets the lines the server returns from FEAT
+func (srv *testServer) setFeatures(features ...string) {
+	srv.mu.Lock()
+	srv.features = features
+	srv.mu.Unlock()
+}
+
+// count returns how many commands starting with prefix were received
+func (srv *testServer) count(prefix string) (n int) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, command := range srv.commands {
+		if strings.HasPrefix(command, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// waitFor polls until cond is true, failing the test if it doesn't
+// happen within a few seconds
+func waitFor(t *testing.T, cond func() bool) {
+	for start := time.Now(); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timed out waiting for condition")
+		}
+	}
+}
+
+// openSessions returns the number of control connections open
+func (srv *testServer) openSessions() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return len(srv.sessions)
+}
+
+// clientIPs returns the IP addresses of all the connections made to the server
+func (srv *testServer) clientIPs() (ips []string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, client := range srv.clients {
+		host, _, _ := net.SplitHostPort(client)
+		ips = append(ips, host)
+	}
+	return ips
+}
+
+// putFile stores a file on the server, making parent directories
+func (srv *testServer) putFile(filePath string, data string, modTime time.Time) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.mkdirAll(path.Dir(filePath))
+	srv.files[filePath] = &testFile{data: []byte(data), modTime: modTime}
+}
+
+// putLink stores a symlink to target on the server, making parent
+// directories
+func (srv *testServer) putLink(linkPath string, target string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.mkdirAll(path.Dir(linkPath))
+	srv.files[linkPath] = &testFile{link: target, modTime: time.Now()}
+}
+
+// lookup returns the file at filePath following symlinks or nil if
+// there isn't one - call with the lock held
+func (srv *testServer) lookup(filePath string) *testFile {
+	file := srv.files[filePath]
+	for i := 0; file != nil && file.link != "" && i < 8; i++ {
+		file = srv.files[file.link]
+	}
+	if file != nil && file.link != "" {
+		return nil
+	}
+	return file
+}
+
+// getFile returns the file stored at filePath or nil
+func (srv *testServer) getFile(filePath string) *testFile {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.files[filePath]
+}
+
+// resolve returns filePath with any symlinks in it replaced by their
+// targets - call with the lock held
+func (srv *testServer) resolve(filePath string) string {
+	resolved := "/"
+	for _, name := range strings.Split(filePath, "/") {
+		if name == "" {
+			continue
+		}
+		resolved = path.Join(resolved, name)
+		for i := 0; i < 8; i++ {
+			file := srv.files[resolved]
+			if file == nil || file.link == "" {
+				break
+			}
+			resolved = file.link
+		}
+	}
+	return resolved
+}
+
+// mkdirAll makes dirPath and all its parents - call with the lock held
+func (srv *testServer) mkdirAll(dirPath string) {
+	for ; dirPath != "/"; dirPath = path.Dir(dirPath) {
+		if _, ok := srv.files[dirPath]; !ok {
+			srv.files[dirPath] = &testFile{isDir: true, modTime: time.Now()}
+		}
+	}
+}
+
+// children returns the sorted names of the entries in dirPath - call
+// with the lock held
+func (srv *testServer) children(dirPath string) (names []string) {
+	for filePath := range srv.files {
+		if filePath != "/" && path.Dir(filePath) == dirPath {
+			names = append(names, path.Base(filePath))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// testSession is a single control connection to the testServer
+type testSession struct {
+	srv        *testServer
+	conn       net.Conn
+	tp         *textproto.Conn
+	cwd        string
+	user       string
+	loggedIn   bool
+	dataLn     net.Listener
+	activeAddr string // address to connect to for active mode after PORT or EPRT
+	rest       int64
+	renameFrom string
+	copyFrom   string
+	prot       string // data channel protection level set with PROT
+	ascii      bool   // set if TYPE A is in effect
+	umask      string // octal mask set with SITE UMASK if any
+}
+
+// serve reads and dispatches commands until QUIT or an error
+func (s *testSession) serve() {
+	defer s.srv.wg.Done()
+	defer func() {
+		s.closeData()
+		_ = s.conn.Close()
+		s.srv.mu.Lock()
+		delete(s.srv.sessions, s)
+		s.srv.mu.Unlock()
+	}()
+	s.srv.mu.Lock()
+	busy := s.srv.busy > 0
+	if busy {
+		s.srv.busy--
+	}
+	s.srv.mu.Unlock()
+	if busy {
+		s.reply(421, "Too many connections")
+		return
+	}
+	s.srv.mu.Lock()
+	banner := s.srv.banner
+	s.srv.mu.Unlock()
+	if len(banner) > 0 {
+		s.replyLines(220, banner...)
+	} else {
+		s.reply(220, "rclone test server ready")
+	}
+	for {
+		line, err := s.tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			cmd, arg = line[:i], line[i+1:]
+		}
+		cmd = strings.ToUpper(cmd)
+		s.srv.mu.Lock()
+		s.srv.commands = append(s.srv.commands, cmd+" "+arg)
+		s.srv.mu.Unlock()
+		if hook := s.srv.getHook(cmd); hook != nil && hook(s, arg) {
+			continue
+		}
+		if s.srv.refuseAbsolute(cmd, arg) {
+			s.reply(550, "Absolute paths not allowed")
+			continue
+		}
+		arg = s.foldCase(cmd, arg)
+		if !s.handle(cmd, arg) {
+			return
+		}
+	}
+}
+
+// reply sends a single line response
+func (s *testSession) reply(code int, format string, args ...interface{}) {
+	_ = s.tp.PrintfLine("%d %s", code, fmt.Sprintf(format, args...))
+}
+
+// replyLines sends a multi-line response
+func (s *testSession) replyLines(code int, lines ...string) {
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		_ = s.tp.PrintfLine("%d%s%s", code, sep, line)
+	}
+}
+
+// abs turns arg into an absolute server path
+func (s *testSession) abs(arg string) string {
+	if !path.IsAbs(arg) {
+		arg = path.Join(s.cwd, arg)
+	}
+	return path.Clean(arg)
+}
+
+// pathCommands are the commands whose argument is a single path
+var pathCommands = map[string]bool{
+	"RETR": true, "STOR": true, "APPE": true, "SIZE": true, "MDTM": true,
+	"MLST": true, "DELE": true, "RNFR": true, "RNTO": true, "CWD": true,
+	"MKD": true, "RMD": true,
+}
+
+// foldCase returns the path in arg as the existing path which matches
+// it case insensitively if ignoreCase is set, so a file can be
+// reached with any case like on Windows servers
+func (s *testSession) foldCase(cmd, arg string) string {
+	srv := s.srv
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !srv.ignoreCase || !pathCommands[cmd] {
+		return arg
+	}
+	filePath := s.abs(arg)
+	if srv.files[filePath] != nil {
+		return filePath
+	}
+	for existing := range srv.files {
+		if strings.EqualFold(existing, filePath) {
+			return existing
+		}
+	}
+	return filePath
+}
+
+// closeData closes any pending passive listener and forgets any
+// active mode address
+func (s *testSession) closeData() {
+	if s.dataLn != nil {
+		_ = s.dataLn.Close()
+		s.dataLn = nil
+	}
+	s.activeAddr = ""
+}
+
+// listenData starts a passive listener returning its port
+func (s *testSession) listenData() (int, error) {
+	s.closeData()
+	ln, err := net.Listen("tcp", net.JoinHostPort(s.srv.host, "0"))
+	if err != nil {
+		return 0, err
+	}
+	s.dataLn = ln
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+// acceptData accepts the data connection for a transfer
+func (s *testSession) acceptData() (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	switch {
+	case s.activeAddr != "":
+		conn, err = net.DialTimeout("tcp", s.activeAddr, 10*time.Second)
+	case s.dataLn != nil:
+		_ = s.dataLn.(*net.TCPListener).SetDeadline(time.Now().Add(10 * time.Second))
+		conn, err = s.dataLn.Accept()
+	default:
+		return nil, fmt.Errorf("no data connection")
+	}
+	s.closeData()
+	if err != nil {
+		return nil, err
+	}
+	s.srv.mu.Lock()
+	s.srv.clients = append(s.srv.clients, conn.RemoteAddr().String())
+	s.srv.mu.Unlock()
+	return conn, nil
+}
+
+// openData accepts the data connection for a transfer and sends the
+// 150 reply.  If the data channel is protected TLS is negotiated
+// after that as the client won't start the handshake until it has
+// read the reply.  It replies 425 and returns nil on failure.
+func (s *testSession) openData(message string) net.Conn {
+	conn, err := s.acceptData()
+	if err != nil {
+		s.reply(425, "Can't open data connection")
+		return nil
+	}
+	s.reply(150, "%s", message)
+	if s.prot != "P" {
+		return conn
+	}
+	tlsConn := tls.Server(conn, s.srv.tlsConfig)
+	err = tlsConn.Handshake()
+	if err != nil {
+		_ = conn.Close()
+		s.reply(425, "TLS negotiation failed")
+		return nil
+	}
+	resumed := tlsConn.ConnectionState().DidResume
+	s.srv.mu.Lock()
+	s.srv.dataResumed = append(s.srv.dataResumed, resumed)
+	requireReuse := s.srv.requireReuse
+	s.srv.mu.Unlock()
+	if requireReuse && !resumed {
+		_ = tlsConn.Close()
+		s.reply(425, "TLS session reuse required")
+		return nil
+	}
+	return tlsConn
+}
+
+// sendData sends data over a new data connection
+func (s *testSession) sendData(data []byte) {
+	conn := s.openData("Opening data connection")
+	if conn == nil {
+		return
+	}
+	_, err := conn.Write(data)
+	_ = conn.Close()
+	if err != nil {
+		s.reply(426, "Connection closed; transfer aborted")
+		return
+	}
+	s.reply(226, "Transfer complete")
+}
+
+// countASCII counts a transfer made in ASCII mode
+func (s *testSession) countASCII() {
+	if s.ascii {
+		s.srv.mu.Lock()
+		s.srv.asciiXfers++
+		s.srv.mu.Unlock()
+	}
+}
+
+// mlstFacts formats the facts about a file for MLST
+func mlstFacts(file *testFile) string {
+	fileType := "file"
+	if file.isDir {
+		fileType = "dir"
+	}
+	return fmt.Sprintf("type=%s;size=%d;modify=%s;", fileType, len(file.data), file.modTime.UTC().Format("20060102150405"))
+}
+
+// listLine formats a file as an ls style listing line
+func listLine(name string, file *testFile) string {
+	mode, size := "-rw-r--r--", len(file.data)
+	switch {
+	case file.isDir:
+		mode, size = "drwxr-xr-x", 0
+	case file.link != "":
+		mode, size = "lrwxrwxrwx", len(file.link)
+		name += " -> " + file.link
+	}
+	return fmt.Sprintf("%s 1 ftp ftp %d %s %s", mode, size, file.modTime.UTC().Format("Jan _2  2006"), name)
+}
+
+// handle a single command returning false if the session should end
+func (s *testSession) handle(cmd, arg string) bool {
+	srv := s.srv
+	switch cmd {
+	case "USER":
+		s.user = arg
+		s.reply(331, "Password required")
+		return true
+	case "PASS":
+		if s.user != testUser || arg != testPass {
+			s.reply(530, "Login incorrect.")
+			return true
+		}
+		s.loggedIn = true
+		srv.mu.Lock()
+		srv.logins++
+		welcome := srv.welcome
+		srv.mu.Unlock()
+		if len(welcome) > 0 {
+			s.replyLines(230, welcome...)
+		} else {
+			s.reply(230, "Login successful")
+		}
+		return true
+	case "FEAT":
+		srv.mu.Lock()
+		features := srv.features
+		srv.mu.Unlock()
+		if len(features) == 0 {
+			s.reply(502, "No features")
+			return true
+		}
+		lines := []string{"Features:"}
+		for _, feature := range features {
+			lines = append(lines, " "+feature)
+		}
+		s.replyLines(211, append(lines, "End")...)
+		return true
+	case "QUIT":
+		s.reply(221, "Goodbye")
+		return false
+	case "REIN":
+		s.loggedIn = false
+		s.user = ""
+		s.umask = ""
+		s.cwd = "/"
+		s.ascii = false
+		s.closeData()
+		s.reply(220, "Service ready for new user")
+		return true
+	case "AUTH":
+		if srv.tlsConfig == nil || strings.ToUpper(arg) != "TLS" {
+			s.reply(504, "AUTH %s not supported", arg)
+			return true
+		}
+		s.reply(234, "Proceed with negotiation")
+		conn := tls.Server(s.conn, srv.tlsConfig)
+		srv.mu.Lock()
+		s.conn = conn
+		srv.mu.Unlock()
+		s.tp = textproto.NewConn(conn)
+		return true
+	case "PBSZ":
+		s.reply(200, "PBSZ=0")
+		return true
+	case "PROT":
+		switch arg = strings.ToUpper(arg); {
+		case arg == "C", arg == "P" && srv.tlsConfig != nil:
+			s.prot = arg
+			s.reply(200, "PROT now %s", arg)
+		default:
+			s.reply(504, "PROT %s not supported", arg)
+		}
+		return true
+	}
+	if !s.loggedIn {
+		s.reply(530, "Please login with USER and PASS")
+		return true
+	}
+	switch cmd {
+	case "TYPE":
+		switch strings.ToUpper(arg) {
+		case "A", "A N":
+			s.ascii = true
+		case "I", "L 8":
+			s.ascii = false
+		default:
+			s.reply(504, "TYPE %s not supported", arg)
+			return true
+		}
+		s.reply(200, "Switching to %s mode", arg)
+	case "OPTS":
+		s.reply(200, "OK")
+	case "ALLO":
+		s.reply(200, "ALLO command successful")
+	case "NOOP":
+		s.reply(200, "NOOP ok")
+	case "SYST":
+		s.reply(215, "UNIX Type: L8")
+	case "PWD":
+		s.reply(257, "%q is the current directory", s.cwd)
+	case "CWD", "CDUP":
+		dir := s.abs(arg)
+		if cmd == "CDUP" {
+			dir = path.Dir(s.cwd)
+		}
+		srv.mu.Lock()
+		file := srv.lookup(srv.resolve(dir))
+		srv.mu.Unlock()
+		if file == nil || !file.isDir {
+			s.reply(550, "Failed to change directory")
+			break
+		}
+		s.cwd = dir
+		s.reply(250, "Directory successfully changed")
+	case "EPSV":
+		port, err := s.listenData()
+		if err != nil {
+			s.reply(425, "Can't open passive connection")
+			break
+		}
+		s.reply(229, "Entering Extended Passive Mode (|||%d|)", port)
+	case "PORT":
+		parts := strings.Split(arg, ",")
+		var p1, p2 int
+		var err error
+		if len(parts) == 6 {
+			p1, err = strconv.Atoi(parts[4])
+			if err == nil {
+				p2, err = strconv.Atoi(parts[5])
+			}
+		}
+		if len(parts) != 6 || err != nil {
+			s.reply(501, "Bad PORT")
+			break
+		}
+		s.closeData()
+		s.activeAddr = net.JoinHostPort(strings.Join(parts[:4], "."), strconv.Itoa(p1*256+p2))
+		s.reply(200, "PORT command successful")
+	case "EPRT":
+		// EPRT |proto|ip|port|
+		parts := strings.Split(arg, "|")
+		if len(parts) != 5 {
+			s.reply(501, "Bad EPRT")
+			break
+		}
+		s.closeData()
+		s.activeAddr = net.JoinHostPort(parts[2], parts[3])
+		s.reply(200, "EPRT command successful")
+	case "PASV":
+		port, err := s.listenData()
+		if err != nil {
+			s.reply(425, "Can't open passive connection")
+			break
+		}
+		srv.mu.Lock()
+		ip := srv.pasvIP
+		srv.mu.Unlock()
+		if ip == "" {
+			ip = srv.host
+		}
+		ip = strings.Replace(ip, ".", ",", -1)
+		s.reply(227, "Entering Passive Mode (%s,%d,%d)", ip, port/256, port%256)
+	case "REST":
+		offset, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			s.reply(501, "Bad offset")
+			break
+		}
+		s.rest = offset
+		s.reply(350, "Restart position accepted")
+	case "LIST", "NLST":
+		all := false
+		if arg == "-a" || strings.HasPrefix(arg, "-a ") {
+			all = true
+			arg = strings.TrimSpace(arg[2:])
+		}
+		srv.mu.Lock()
+		cwdListing := srv.cwdListing
+		srv.mu.Unlock()
+		if cwdListing && arg != "" {
+			s.closeData()
+			s.reply(550, "Permission denied")
+			break
+		}
+		dir := s.abs(arg)
+		srv.mu.Lock()
+		// directories are listed through symlinks
+		if resolved := srv.resolve(dir); srv.files[resolved] != nil && srv.files[resolved].isDir {
+			dir = resolved
+		}
+		file := srv.files[dir]
+		var lines []string
+		if file != nil && file.isDir {
+			for _, name := range srv.children(dir) {
+				if srv.hideDots && !all && strings.HasPrefix(name, ".") {
+					continue
+				}
+				if cmd == "NLST" {
+					lines = append(lines, name)
+				} else {
+					lines = append(lines, listLine(name, srv.files[path.Join(dir, name)]))
+				}
+			}
+		} else if file != nil {
+			lines = append(lines, listLine(path.Base(dir), file))
+		}
+		srv.mu.Unlock()
+		if file == nil {
+			s.closeData()
+			s.reply(550, "No such file or directory")
+			break
+		}
+		var out []byte
+		for _, line := range lines {
+			out = append(out, line+"\r\n"...)
+		}
+		s.sendData(out)
+	case "STAT":
+		srv.mu.Lock()
+		stat := srv.stat
+		srv.mu.Unlock()
+		if !stat || arg == "" {
+			s.reply(502, "STAT not implemented")
+			break
+		}
+		statPath := s.abs(arg)
+		lines := []string{"Status of " + arg + ":"}
+		srv.mu.Lock()
+		file := srv.files[statPath]
+		if file != nil && file.isDir {
+			for _, name := range srv.children(statPath) {
+				lines = append(lines, listLine(name, srv.files[path.Join(statPath, name)]))
+			}
+		} else if file != nil {
+			lines = append(lines, listLine(path.Base(statPath), file))
+		}
+		srv.mu.Unlock()
+		s.replyLines(213, append(lines, "End of status")...)
+	case "RETR":
+		filePath := s.abs(arg)
+		srv.mu.Lock()
+		file := srv.lookup(filePath)
+		srv.mu.Unlock()
+		offset := s.rest
+		s.rest = 0
+		s.countASCII()
+		if file == nil || file.isDir {
+			s.closeData()
+			s.reply(550, "Failed to open file")
+			break
+		}
+		if offset > int64(len(file.data)) {
+			offset = int64(len(file.data))
+		}
+		s.sendData(file.data[offset:])
+	case "STOR", "APPE":
+		filePath := s.abs(arg)
+		rest := s.rest
+		s.rest = 0
+		s.countASCII()
+		srv.mu.Lock()
+		parent := srv.files[path.Dir(filePath)]
+		srv.mu.Unlock()
+		if parent == nil || !parent.isDir {
+			s.closeData()
+			s.reply(553, "Could not create file")
+			break
+		}
+		conn := s.openData("Ok to send data")
+		if conn == nil {
+			break
+		}
+		data, err := ioutil.ReadAll(bufio.NewReader(conn))
+		_ = conn.Close()
+		if err != nil {
+			s.reply(426, "Connection closed; transfer aborted")
+			break
+		}
+		srv.mu.Lock()
+		if old := srv.files[filePath]; old != nil && !old.isDir {
+			switch {
+			case cmd == "APPE":
+				data = append(old.data, data...)
+			case rest > 0 && rest <= int64(len(old.data)):
+				data = append(old.data[:rest:rest], data...)
+			}
+		}
+		srv.files[filePath] = &testFile{data: data, modTime: time.Now(), mode: s.createMode(0666)}
+		srv.mu.Unlock()
+		s.reply(226, "Transfer complete")
+	case "MLST":
+		filePath := s.abs(arg)
+		srv.mu.Lock()
+		file := srv.lookup(filePath)
+		srv.mu.Unlock()
+		if file == nil {
+			s.reply(550, "No such file or directory")
+			break
+		}
+		_ = s.tp.PrintfLine("250-Listing %s", arg)
+		_ = s.tp.PrintfLine(" %s %s", mlstFacts(file), filePath)
+		s.reply(250, "End")
+	case "MLSD":
+		dir := s.abs(arg)
+		srv.mu.Lock()
+		file := srv.files[dir]
+		var out []byte
+		if file != nil && file.isDir {
+			for _, name := range srv.children(dir) {
+				out = append(out, mlstFacts(srv.files[path.Join(dir, name)])+" "+name+"\r\n"...)
+			}
+		}
+		srv.mu.Unlock()
+		if file == nil || !file.isDir {
+			s.closeData()
+			s.reply(550, "No such directory")
+			break
+		}
+		s.sendData(out)
+	case "SIZE":
+		srv.mu.Lock()
+		file := srv.lookup(s.abs(arg))
+		srv.mu.Unlock()
+		if file == nil || file.isDir {
+			s.reply(550, "Could not get file size")
+			break
+		}
+		s.reply(213, "%d", len(file.data))
+	case "MDTM":
+		srv.mu.Lock()
+		file := srv.lookup(s.abs(arg))
+		srv.mu.Unlock()
+		if file == nil {
+			s.reply(550, "Could not get file modification time")
+			break
+		}
+		s.reply(213, "%s", file.modTime.UTC().Format("20060102150405"))
+	case "MFMT":
+		var modTime time.Time
+		var err error
+		if i := strings.IndexByte(arg, ' '); i >= 0 {
+			modTime, err = time.Parse("20060102150405", arg[:i])
+			arg = arg[i+1:]
+		}
+		srv.mu.Lock()
+		file := srv.lookup(s.abs(arg))
+		ok := file != nil && err == nil && !modTime.IsZero()
+		if ok {
+			file.modTime = modTime
+		}
+		srv.mu.Unlock()
+		if !ok {
+			s.reply(550, "Could not set modification time")
+			break
+		}
+		s.reply(213, "Modify=%s; %s", modTime.Format("20060102150405"), arg)
+	case "MFF":
+		var facts string
+		if i := strings.IndexByte(arg, ' '); i >= 0 {
+			facts, arg = arg[:i], arg[i+1:]
+		}
+		srv.mu.Lock()
+		file := srv.lookup(s.abs(arg))
+		ok := file != nil && facts != ""
+		for _, fact := range strings.Split(strings.TrimSuffix(facts, ";"), ";") {
+			if !ok {
+				break
+			}
+			var modTime time.Time
+			var err error
+			name, value := fact, ""
+			if i := strings.IndexByte(fact, '='); i >= 0 {
+				name, value = fact[:i], fact[i+1:]
+			}
+			switch strings.ToLower(name) {
+			case "modify":
+				modTime, err = time.Parse("20060102150405", value)
+				ok = err == nil
+				if ok {
+					file.modTime = modTime
+				}
+			case "unix.mode":
+				_, err = strconv.ParseUint(value, 8, 32)
+				ok = err == nil
+				if ok {
+					file.mode = value
+				}
+			default:
+				ok = false
+			}
+		}
+		srv.mu.Unlock()
+		if !ok {
+			s.reply(504, "Could not set facts")
+			break
+		}
+		s.reply(213, "%s %s", facts, arg)
+	case "DELE":
+		filePath := s.abs(arg)
+		srv.mu.Lock()
+		file := srv.files[filePath]
+		if file != nil && !file.isDir {
+			delete(srv.files, filePath)
+		}
+		srv.mu.Unlock()
+		if file == nil || file.isDir {
+			s.reply(550, "Delete operation failed")
+			break
+		}
+		s.reply(250, "Delete operation successful")
+	case "MKD":
+		dirPath := s.abs(arg)
+		srv.mu.Lock()
+		parent, existing := srv.files[path.Dir(dirPath)], srv.files[dirPath]
+		ok := existing == nil && parent != nil && parent.isDir
+		if ok {
+			srv.files[dirPath] = &testFile{isDir: true, modTime: time.Now(), mode: s.createMode(0777)}
+		}
+		srv.mu.Unlock()
+		if !ok {
+			s.reply(550, "Create directory operation failed")
+			break
+		}
+		s.reply(257, "%q created", dirPath)
+	case "RMD":
+		dirPath := s.abs(arg)
+		srv.mu.Lock()
+		file := srv.files[dirPath]
+		ok := file != nil && file.isDir && dirPath != "/" && len(srv.children(dirPath)) == 0
+		if ok {
+			delete(srv.files, dirPath)
+		}
+		srv.mu.Unlock()
+		if !ok {
+			s.reply(550, "Remove directory operation failed")
+			break
+		}
+		s.reply(250, "Remove directory operation successful")
+	case "RNFR":
+		srv.mu.Lock()
+		file := srv.files[s.abs(arg)]
+		srv.mu.Unlock()
+		if file == nil {
+			s.reply(550, "RNFR command failed")
+			break
+		}
+		s.renameFrom = s.abs(arg)
+		s.reply(350, "Ready for RNTO")
+	case "RNTO":
+		from, to := s.renameFrom, s.abs(arg)
+		s.renameFrom = ""
+		srv.mu.Lock()
+		parent := srv.files[path.Dir(to)]
+		ok := from != "" && srv.files[from] != nil && parent != nil && parent.isDir
+		if srv.noReplace && srv.files[to] != nil {
+			ok = false
+		}
+		if ok {
+			for filePath, file := range srv.files {
+				if filePath == from || strings.HasPrefix(filePath, from+"/") {
+					delete(srv.files, filePath)
+					srv.files[to+filePath[len(from):]] = file
+				}
+			}
+		}
+		srv.mu.Unlock()
+		if !ok {
+			s.reply(550, "Rename failed")
+			break
+		}
+		s.reply(250, "Rename successful")
+	case "SITE":
+		s.site(arg)
+	default:
+		s.reply(502, "Command not implemented")
+	}
+	return true
+}
+
+// splitQuoted splits arg into the double quoted strings in it, with
+// doubled double quotes in them undoubled
+func splitQuoted(arg string) (out []string) {
+	for {
+		arg = strings.TrimLeft(arg, " ")
+		if !strings.HasPrefix(arg, `"`) {
+			return out
+		}
+		var word []byte
+		i := 1
+		for ; i < len(arg); i++ {
+			if arg[i] == '"' {
+				if i+1 < len(arg) && arg[i+1] == '"' {
+					word = append(word, '"')
+					i++
+					continue
+				}
+				break
+			}
+			word = append(word, arg[i])
+		}
+		out = append(out, string(word))
+		if i >= len(arg) {
+			return out
+		}
+		arg = arg[i+1:]
+	}
+}
+
+// createMode returns the octal mode of a file or directory made
+// with permissions perm less the session's umask, or "" if there is
+// no umask
+func (s *testSession) createMode(perm uint64) string {
+	if s.umask == "" {
+		return ""
+	}
+	umask, _ := strconv.ParseUint(s.umask, 8, 32)
+	return strconv.FormatUint(perm&^umask, 8)
+}
+
+// site handles the SITE commands
+func (s *testSession) site(arg string) {
+	srv := s.srv
+	cmd, arg := arg, ""
+	if i := strings.IndexByte(cmd, ' '); i >= 0 {
+		cmd, arg = cmd[:i], cmd[i+1:]
+	}
+	switch strings.ToUpper(cmd) {
+	case "UMASK":
+		if _, err := strconv.ParseUint(arg, 8, 32); err != nil {
+			s.reply(501, "Bad umask")
+			break
+		}
+		s.umask = arg
+		s.reply(200, "UMASK set to %s", arg)
+	case "CPFR":
+		srv.mu.Lock()
+		file := srv.files[s.abs(arg)]
+		srv.mu.Unlock()
+		if file == nil || file.isDir {
+			s.reply(550, "%s: No such file or directory", arg)
+			break
+		}
+		s.copyFrom = s.abs(arg)
+		s.reply(350, "File or directory exists, ready for destination name")
+	case "CPTO":
+		from, to := s.copyFrom, s.abs(arg)
+		s.copyFrom = ""
+		srv.mu.Lock()
+		file, parent := srv.files[from], srv.files[path.Dir(to)]
+		ok := from != "" && file != nil && parent != nil && parent.isDir
+		if ok {
+			srv.files[to] = &testFile{data: append([]byte(nil), file.data...), modTime: time.Now()}
+		}
+		srv.mu.Unlock()
+		if !ok {
+			s.reply(550, "SITE CPTO failed")
+			break
+		}
+		s.reply(250, "Copy successful")
+	case "CONCAT":
+		paths := splitQuoted(arg)
+		if len(paths) < 2 {
+			s.reply(501, "Bad arguments")
+			break
+		}
+		to := s.abs(paths[0])
+		var data []byte
+		srv.mu.Lock()
+		ok := srv.files[path.Dir(to)] != nil
+		for _, from := range paths[1:] {
+			file := srv.files[s.abs(from)]
+			if file == nil || file.isDir {
+				ok = false
+				break
+			}
+			data = append(data, file.data...)
+		}
+		if ok {
+			srv.files[to] = &testFile{data: data, modTime: time.Now()}
+		}
+		srv.mu.Unlock()
+		if !ok {
+			s.reply(550, "SITE CONCAT failed")
+			break
+		}
+		s.reply(250, "Concatenated %d files", len(paths)-1)
+	case "CHMOD":
+		var mode string
+		if i := strings.IndexByte(arg, ' '); i >= 0 {
+			mode, arg = arg[:i], arg[i+1:]
+		}
+		srv.mu.Lock()
+		file := srv.lookup(s.abs(arg))
+		if file != nil {
+			file.mode = mode
+		}
+		srv.mu.Unlock()
+		if file == nil || mode == "" {
+			s.reply(550, "%s: No such file or directory", arg)
+			break
+		}
+		s.reply(200, "SITE CHMOD command successful")
+	default:
+		s.reply(500, "'SITE %s' not understood", strings.ToUpper(cmd))
+	}
+}
+
+// remoteNumber is used to make unique remote names for each test
+var remoteNumber int
+
+// newTestFs configures a remote pointing at srv with the extra
+// config given and returns NewFs for it.
+func newTestFs(srv *testServer, root string, extra map[string]string) (*Fs, error) {
+	config.LoadConfig()
+	remoteNumber++
+	name := fmt.Sprintf("TestFTPInternal%d", remoteNumber)
+	config.FileSet(name, "type", "ftp")
+	config.FileSet(name, "host", srv.host)
+	config.FileSet(name, "port", srv.port)
+	config.FileSet(name, "user", testUser)
+	config.FileSet(name, "pass", obscure.MustObscure(testPass))
+	for key, value := range extra {
+		config.FileSet(name, key, value)
+	}
+	f, err := NewFs(name, root)
+	if f == nil {
+		return nil, err
+	}
+	return f.(*Fs), err
+}
+
+// prepare starts a testServer and makes an Fs pointing at it
+// returning a function to tidy up afterwards
+func prepare(t *testing.T, extra map[string]string) (*testServer, *Fs, func()) {
+	srv := newTestServer(t)
+	f, err := newTestFs(srv, "", extra)
+	if err != nil {
+		srv.Close()
+	}
+	require.NoError(t, err)
+	return srv, f, func() {
+		_ = f.drainPool()
+		srv.Close()
+	}
+}
+
+// prepareTLS is like prepare but starts a testServer using implicit
+// or explicit TLS and configures the Fs to match
+func prepareTLS(t *testing.T, implicit bool, extra map[string]string) (*testServer, *Fs, func()) {
+	srv := newTestTLSServer(t, implicit)
+	opts := map[string]string{
+		"no_check_certificate": "true",
+	}
+	if implicit {
+		opts["tls"] = "true"
+	} else {
+		opts["explicit_tls"] = "true"
+	}
+	for key, value := range extra {
+		opts[key] = value
+	}
+	f, err := newTestFs(srv, "", opts)
+	if err != nil {
+		srv.Close()
+	}
+	require.NoError(t, err)
+	return srv, f, func() {
+		_ = f.drainPool()
+		srv.Close()
+	}
+}
+
+// testSocksServer is a minimal SOCKS5 proxy which counts the
+// connections made through it
+type testSocksServer struct {
+	listener net.Listener
+	addr     string
+	user     string // if set require this user
+	mu       sync.Mutex
+	targets  []string // addresses connected to
+}
+
+// newTestSocksServer starts a SOCKS5 proxy listening on localhost
+func newTestSocksServer(t *testing.T, user string) *testSocksServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	p := &testSocksServer{
+		listener: listener,
+		addr:     listener.Addr().String(),
+		user:     user,
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.handle(conn)
+		}
+	}()
+	return p
+}
+
+// Close stops the proxy accepting new connections
+func (p *testSocksServer) Close() {
+	_ = p.listener.Close()
+}
+
+// connections returns the addresses connected to through the proxy
+func (p *testSocksServer) connections() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+// handle a single proxied connection
+func (p *testSocksServer) handle(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	r := bufio.NewReader(conn)
+	readN := func(n int) []byte {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil
+		}
+		return buf
+	}
+	// greeting: version, number of methods, methods
+	header := readN(2)
+	if header == nil || header[0] != 5 || readN(int(header[1])) == nil {
+		return
+	}
+	if p.user == "" {
+		_, _ = conn.Write([]byte{5, 0})
+	} else {
+		_, _ = conn.Write([]byte{5, 2})
+		// username/password: version, ulen, user, plen, pass
+		version := readN(1)
+		ulen := readN(1)
+		if version == nil || ulen == nil {
+			return
+		}
+		user := readN(int(ulen[0]))
+		plen := readN(1)
+		if user == nil || plen == nil || readN(int(plen[0])) == nil {
+			return
+		}
+		if string(user) != p.user {
+			_, _ = conn.Write([]byte{1, 1})
+			return
+		}
+		_, _ = conn.Write([]byte{1, 0})
+	}
+	// request: version, command, reserved, address type
+	request := readN(4)
+	if request == nil || request[1] != 1 {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := readN(4)
+		if ip == nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case 3:
+		n := readN(1)
+		if n == nil {
+			return
+		}
+		host = string(readN(int(n[0])))
+	default:
+		return
+	}
+	portBytes := readN(2)
+	if portBytes == nil {
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(portBytes[0])<<8|int(portBytes[1])))
+	out, err := net.Dial("tcp", target)
+	if err != nil {
+		_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer func() { _ = out.Close() }()
+	p.mu.Lock()
+	p.targets = append(p.targets, target)
+	p.mu.Unlock()
+	_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(out, r)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(conn, out)
+		done <- struct{}{}
+	}()
+	<-done
+}
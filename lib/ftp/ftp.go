@@ -0,0 +1,1369 @@
+// Package ftp implements a FTP client as described in RFC 959.
+//
+// A textproto.Error is returned for errors at the protocol level.
+//
+// This is a fork of github.com/jlaffaye/ftp with the changes the FTP
+// backend needs.
+package ftp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EntryType describes the different types of an Entry.
+type EntryType int
+
+// The differents types of an Entry
+const (
+	EntryTypeFile EntryType = iota
+	EntryTypeFolder
+	EntryTypeLink
+)
+
+// ServerConn represents the connection to a remote FTP server.
+// It should be protected from concurrent accesses.
+type ServerConn struct {
+	// Do not use EPSV mode
+	DisableEPSV bool
+
+	options       *dialOptions
+	conn          *textproto.Conn
+	netConn       net.Conn // connection under conn, for setting deadlines
+	host          string
+	localIP       net.IP // local address of the control connection
+	features      map[string]string
+	mlstSupported bool
+	protPrivate   bool // set if data connections use TLS
+}
+
+// DialOption represents an option to start a new connection with Dial
+type DialOption struct {
+	setup func(do *dialOptions)
+}
+
+// dialOptions contains all the options set by DialOption.setup
+type dialOptions struct {
+	dialer          net.Dialer
+	dialFunc        func(network, address string) (net.Conn, error)
+	tlsConfig       *tls.Config
+	explicitTLS     bool
+	forceListHidden bool
+	forceControlIP  bool
+	disableMLSD     bool
+	activeMode      bool
+	activePortMin   int
+	activePortMax   int
+	dataTimeout     time.Duration
+	commandTimeout  time.Duration
+	replyTimeout    time.Duration
+	listParsers     []parseFunc
+	location        *time.Location
+	encode          func(string) (string, error)
+	decode          func(string) (string, error)
+}
+
+// Entry describes a file and is returned by List().
+type Entry struct {
+	Name   string
+	Target string // target of symbolic link
+	Type   EntryType
+	Size   uint64
+	Time   time.Time
+}
+
+// Response represents a data-connection
+type Response struct {
+	conn   net.Conn
+	c      *ServerConn
+	closed bool
+}
+
+// Connect is an alias to Dial, for backward compatibility
+func Connect(addr string) (*ServerConn, error) {
+	return Dial(addr)
+}
+
+// Dial connects to the specified address with optional options
+//
+// It is generally followed by a call to Login() as most FTP commands require
+// an authenticated user.
+func Dial(addr string, options ...DialOption) (*ServerConn, error) {
+	do := &dialOptions{}
+	for _, option := range options {
+		option.setup(do)
+	}
+
+	var tconn net.Conn
+	var err error
+	if do.dialFunc != nil {
+		tconn, err = do.dialFunc("tcp", addr)
+	} else {
+		tconn, err = do.dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var host string
+	if remoteAddr, ok := tconn.RemoteAddr().(*net.TCPAddr); ok {
+		// Use the resolved IP address in case addr contains a domain name
+		// If we use the domain name, we might not resolve to the same IP.
+		host = remoteAddr.IP.String()
+	} else {
+		// The connection is going through a proxy which doesn't
+		// know the IP address of the server so use the address we
+		// were asked to connect to for the data connections
+		host, _, err = net.SplitHostPort(addr)
+		if err != nil {
+			tconn.Close()
+			return nil, err
+		}
+	}
+
+	var localIP net.IP
+	if addr, ok := tconn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = addr.IP
+	}
+
+	if do.tlsConfig != nil && !do.explicitTLS {
+		tconn = tls.Client(tconn, do.tlsConfig)
+	}
+
+	conn := textproto.NewConn(tconn)
+
+	c := &ServerConn{
+		options:  do,
+		conn:     conn,
+		netConn:  tconn,
+		host:     host,
+		localIP:  localIP,
+		features: make(map[string]string),
+	}
+
+	_, _, err = c.conn.ReadResponse(StatusReady)
+	if err != nil {
+		c.Quit()
+		return nil, err
+	}
+
+	if do.explicitTLS {
+		if err := c.authTLS(); err != nil {
+			c.Quit()
+			return nil, err
+		}
+		tconn = tls.Client(tconn, do.tlsConfig)
+		c.conn = textproto.NewConn(tconn)
+		c.netConn = tconn
+	}
+
+	err = c.feat()
+	if err != nil {
+		c.Quit()
+		return nil, err
+	}
+
+	if _, mlstSupported := c.features["MLST"]; mlstSupported && !c.options.disableMLSD {
+		c.mlstSupported = true
+	}
+
+	return c, nil
+}
+
+// DialWithTimeout returns a DialOption that configures the ServerConn with specified timeout
+func DialWithTimeout(timeout time.Duration) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.dialer.Timeout = timeout
+	}}
+}
+
+// DialWithDialer returns a DialOption that configures the ServerConn with specified net.Dialer
+func DialWithDialer(dialer net.Dialer) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.dialer = dialer
+	}}
+}
+
+// DialWithDialFunc returns a DialOption that configures the ServerConn to use the
+// specified function to establish both control and data connections
+//
+// The data connections are made to the IP address of the control
+// connection if its RemoteAddr is a *net.TCPAddr, otherwise, eg when
+// going through a proxy, to the host the control connection was made to.
+func DialWithDialFunc(f func(network, address string) (net.Conn, error)) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.dialFunc = f
+	}}
+}
+
+// DialWithTLS returns a DialOption that configures the ServerConn with specified TLS config
+//
+// If called together with the DialWithDialFunc option, the DialWithDialFunc function
+// will be used when dialing new connections but regardless of the function,
+// the connection will be treated as a TLS connection.
+func DialWithTLS(tlsConfig *tls.Config) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.tlsConfig = tlsConfig
+	}}
+}
+
+// DialWithExplicitTLS returns a DialOption that configures the ServerConn to be upgraded to TLS
+// See DialWithTLS for general TLS documentation
+func DialWithExplicitTLS(tlsConfig *tls.Config) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.explicitTLS = true
+		do.tlsConfig = tlsConfig
+	}}
+}
+
+// DialWithForceListHidden returns a DialOption making List use
+// "LIST -a" so servers which hide dotfiles by default include them.
+// It has no effect when the server supports MLSD.
+func DialWithForceListHidden(enabled bool) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.forceListHidden = enabled
+	}}
+}
+
+// DialWithDisabledMLSD returns a DialOption making List use LIST even
+// if the server advertises MLST, for servers whose MLSD listings are
+// broken.
+func DialWithDisabledMLSD(disabled bool) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.disableMLSD = disabled
+	}}
+}
+
+// DialWithForceControlIP returns a DialOption making data connections
+// opened after PASV go to the host of the control connection rather
+// than the address in the PASV reply, for servers behind NAT which
+// advertise an address the client can't reach.
+func DialWithForceControlIP(enabled bool) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.forceControlIP = enabled
+	}}
+}
+
+// DialWithActiveMode returns a DialOption making data connections use
+// active mode: the client listens and the server connects to it after
+// PORT or EPRT.  The listening port is chosen from portMin to portMax
+// inclusive, or by the system if they are 0.
+func DialWithActiveMode(portMin, portMax int) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.activeMode = true
+		do.activePortMin = portMin
+		do.activePortMax = portMax
+	}}
+}
+
+// DialWithDataTimeout returns a DialOption making reads and writes on
+// data connections fail if they make no progress for timeout, so a
+// stalled transfer doesn't hang forever.
+func DialWithDataTimeout(timeout time.Duration) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.dataTimeout = timeout
+	}}
+}
+
+// DialWithCommandTimeout returns a DialOption that makes commands on
+// the control connection fail with a *CommandTimeoutError if the
+// server hasn't replied to them within timeout.  The connection
+// shouldn't be used again after this happens as the reply may still
+// arrive.
+//
+// The final reply to a transfer, sent when its data connection is
+// closed, isn't subject to the timeout.  Use
+// DialWithTransferReplyTimeout for that.
+func DialWithCommandTimeout(timeout time.Duration) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.commandTimeout = timeout
+	}}
+}
+
+// DialWithTransferReplyTimeout returns a DialOption that makes
+// closing a transfer fail with a *TransferReplyTimeoutError if the
+// server hasn't sent the final reply to it, usually 226 Transfer
+// complete, within timeout.  This is for servers which sometimes close
+// the data connection without sending it.  As with
+// DialWithCommandTimeout the connection shouldn't be used again after
+// this happens.
+func DialWithTransferReplyTimeout(timeout time.Duration) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.replyTimeout = timeout
+	}}
+}
+
+// DialWithListParser returns a DialOption that parses LIST lines in
+// the format name, one of ListParsers, rather than detecting the
+// format of each line.  This helps with servers whose listings are
+// mistaken for another format.  An unknown name detects the format.
+// MLSD listings are always parsed as defined in RFC 3659.
+func DialWithListParser(name string) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.listParsers = listParsersByName[name]
+	}}
+}
+
+// DialWithLocation returns a DialOption making directory listings be
+// read as having times in loc, the server's time zone, rather than UTC.
+// Times in MLSD listings are always UTC.
+func DialWithLocation(loc *time.Location) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.location = loc
+	}}
+}
+
+// DialWithEncoding returns a DialOption converting commands, and so
+// the paths in them, with encode before they are sent and replies and
+// directory listings with decode after they are read, for servers
+// which don't use UTF-8 for file names.  OPTS UTF8 isn't sent when
+// it is used.
+func DialWithEncoding(encode, decode func(string) (string, error)) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.encode = encode
+		do.decode = decode
+	}}
+}
+
+// DialTimeout initializes the connection to the specified ftp server address.
+//
+// It is generally followed by a call to Login() as most FTP commands require
+// an authenticated user.
+func DialTimeout(addr string, timeout time.Duration) (*ServerConn, error) {
+	return Dial(addr, DialWithTimeout(timeout))
+}
+
+// Login authenticates the client with specified user and password.
+//
+// "anonymous"/"anonymous" is a common user/password scheme for FTP servers
+// that allows anonymous read-only accounts.
+func (c *ServerConn) Login(user, password string) error {
+	code, message, err := c.cmd(-1, "USER %s", user)
+	if err != nil {
+		return err
+	}
+
+	switch code {
+	case StatusLoggedIn:
+	case StatusUserOK:
+		_, _, err = c.cmd(StatusLoggedIn, "PASS %s", password)
+		if err != nil {
+			return err
+		}
+	default:
+		return &textproto.Error{Code: code, Msg: message}
+	}
+
+	return c.FinishLogin()
+}
+
+// FinishLogin switches the connection to binary mode and to UTF-8 if
+// the server supports it, as Login does once logged in.  Call it
+// after logging in with Quote for servers needing a login sequence
+// Login doesn't send.
+func (c *ServerConn) FinishLogin() error {
+	// Switch to binary mode
+	if _, _, err := c.cmd(StatusCommandOK, "TYPE I"); err != nil {
+		return err
+	}
+
+	// Switch to UTF-8
+	return c.setUTF8()
+}
+
+// Prot issues a PROT FTP command to set the protection level of the
+// data connections, "P" (private) to encrypt them with TLS or "C"
+// (clear) to send them unencrypted.  It should be preceded by "PBSZ
+// 0" and is only useful on a TLS connection.
+func (c *ServerConn) Prot(level string) error {
+	_, _, err := c.cmd(StatusCommandOK, "PROT %s", level)
+	if err != nil {
+		return err
+	}
+	c.protPrivate = level == "P"
+	return nil
+}
+
+// authTLS upgrades the connection to use TLS
+func (c *ServerConn) authTLS() error {
+	_, _, err := c.cmd(StatusAuthOK, "AUTH TLS")
+	return err
+}
+
+// feat issues a FEAT FTP command to list the additional commands supported by
+// the remote FTP server.
+// FEAT is described in RFC 2389
+func (c *ServerConn) feat() error {
+	code, message, err := c.cmd(-1, "FEAT")
+	if err != nil {
+		return err
+	}
+
+	if code != StatusSystem {
+		// The server does not support the FEAT command. This is not an
+		// error: we consider that there is no additional feature.
+		return nil
+	}
+
+	lines := strings.Split(message, "\n")
+	for _, line := range lines {
+		if !strings.HasPrefix(line, " ") {
+			continue
+		}
+
+		line = strings.TrimSpace(line)
+		featureElements := strings.SplitN(line, " ", 2)
+
+		command := featureElements[0]
+
+		var commandDesc string
+		if len(featureElements) == 2 {
+			commandDesc = featureElements[1]
+		}
+
+		c.features[command] = commandDesc
+	}
+
+	return nil
+}
+
+// setUTF8 issues an "OPTS UTF8 ON" command.
+func (c *ServerConn) setUTF8() error {
+	if c.options.encode != nil {
+		return nil
+	}
+	if _, ok := c.features["UTF8"]; !ok {
+		return nil
+	}
+
+	code, message, err := c.cmd(-1, "OPTS UTF8 ON")
+	if err != nil {
+		return err
+	}
+
+	// The ftpd "filezilla-server" has FEAT support for UTF8, but always returns
+	// "202 UTF8 mode is always enabled. No need to send this command." when
+	// trying to use it. That's OK
+	if code == StatusCommandNotImplemented {
+		return nil
+	}
+
+	if code != StatusCommandOK {
+		return &textproto.Error{Code: code, Msg: message}
+	}
+
+	return nil
+}
+
+// epsv issues an "EPSV" command to get a port number for a data connection.
+func (c *ServerConn) epsv() (port int, err error) {
+	_, line, err := c.cmd(StatusExtendedPassiveMode, "EPSV")
+	if err != nil {
+		return
+	}
+
+	start := strings.Index(line, "|||")
+	end := strings.LastIndex(line, "|")
+	if start == -1 || end == -1 {
+		err = errors.New("Invalid EPSV response format")
+		return
+	}
+	port, err = strconv.Atoi(line[start+3 : end])
+	return
+}
+
+// pasv issues a "PASV" command to get a host and port number for a data connection.
+func (c *ServerConn) pasv() (host string, port int, err error) {
+	_, line, err := c.cmd(StatusPassiveMode, "PASV")
+	if err != nil {
+		return "", 0, err
+	}
+
+	// PASV response format : 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2).
+	start := strings.Index(line, "(")
+	end := strings.LastIndex(line, ")")
+	if start == -1 || end == -1 {
+		return "", 0, errors.New("Invalid PASV response format")
+	}
+
+	// We have to split the response string
+	pasvData := strings.Split(line[start+1:end], ",")
+
+	if len(pasvData) < 6 {
+		return "", 0, errors.New("Invalid PASV response format")
+	}
+
+	// Let's compute the port number
+	portPart1, err := strconv.Atoi(pasvData[4])
+	if err != nil {
+		return "", 0, err
+	}
+
+	portPart2, err := strconv.Atoi(pasvData[5])
+	if err != nil {
+		return "", 0, err
+	}
+
+	// Recompose port
+	port = portPart1*256 + portPart2
+
+	// Make the IP address to connect to, using the host of the
+	// control connection if asked to or if the server didn't
+	// give a usable one
+	host = strings.Join(pasvData[0:4], ".")
+	if ip := net.ParseIP(host); c.options.forceControlIP || ip == nil || ip.IsUnspecified() {
+		host = c.host
+	}
+	return host, port, nil
+}
+
+// getDataConnPort returns a host, port for a new data connection
+// it uses the best available method to do so
+func (c *ServerConn) getDataConnPort() (string, int, error) {
+	if !c.DisableEPSV {
+		if port, err := c.epsv(); err == nil {
+			return c.host, port, nil
+		}
+
+		// if there is an error, disable EPSV for the next attempts
+		c.DisableEPSV = true
+	}
+
+	return c.pasv()
+}
+
+// openDataConn creates a new FTP data connection.
+func (c *ServerConn) openDataConn() (net.Conn, error) {
+	host, port, err := c.getDataConnPort()
+	if err != nil {
+		return nil, err
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	var conn net.Conn
+	if c.options.dialFunc != nil {
+		conn, err = c.options.dialFunc("tcp", addr)
+	} else {
+		conn, err = c.options.dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return c.wrapDataConn(conn), nil
+}
+
+// wrapDataConn sets the data timeout on a data connection and starts
+// TLS on it if it is protected.
+func (c *ServerConn) wrapDataConn(conn net.Conn) net.Conn {
+	if c.options.dataTimeout > 0 {
+		conn = &deadlineConn{Conn: conn, timeout: c.options.dataTimeout}
+	}
+	if c.options.tlsConfig != nil && c.protPrivate {
+		// We don't use tls.DialWithDialer here (which does Dial, create
+		// the Client and then do the Handshake) because it seems to
+		// hang with some FTP servers, namely proftpd and pureftpd.
+		//
+		// Instead we do Dial, create the Client and wait for the first
+		// Read or Write to trigger the Handshake.
+		//
+		// This means that if we are uploading a zero sized file, we
+		// need to make sure we do the Handshake explicitly as Write
+		// won't have been called. This is done in StorFrom().
+		//
+		// The same tls.Config is used as for the control connection so
+		// if it has a ClientSessionCache the TLS session is resumed,
+		// which some servers require.
+		return tls.Client(conn, c.options.tlsConfig)
+	}
+	return conn
+}
+
+// deadlineConn is a net.Conn which extends its deadline before each
+// Read or Write so they fail if they make no progress for timeout.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+// Read implements io.Reader.
+func (d *deadlineConn) Read(p []byte) (int, error) {
+	if err := d.Conn.SetDeadline(time.Now().Add(d.timeout)); err != nil {
+		return 0, err
+	}
+	return d.Conn.Read(p)
+}
+
+// Write implements io.Writer.
+func (d *deadlineConn) Write(p []byte) (int, error) {
+	if err := d.Conn.SetDeadline(time.Now().Add(d.timeout)); err != nil {
+		return 0, err
+	}
+	return d.Conn.Write(p)
+}
+
+// listenActive opens a listener for an active mode data connection on
+// the address of the control connection, using a free port in the
+// configured range, and tells the server about it with PORT or EPRT.
+func (c *ServerConn) listenActive() (net.Listener, error) {
+	ip := c.localIP
+	if ip == nil {
+		return nil, errors.New("active mode needs a TCP control connection")
+	}
+	ln, err := c.listenActivePort(ip)
+	if err != nil {
+		return nil, err
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	if ip4 := ip.To4(); ip4 != nil {
+		_, _, err = c.cmd(StatusCommandOK, "PORT %d,%d,%d,%d,%d,%d", ip4[0], ip4[1], ip4[2], ip4[3], port/256, port%256)
+	} else {
+		_, _, err = c.cmd(StatusCommandOK, "EPRT |2|%s|%d|", ip.String(), port)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// listenActivePort listens on ip using the first free port in the
+// configured range, starting at a random point in it so concurrent
+// connections don't all contend for the same port.
+func (c *ServerConn) listenActivePort(ip net.IP) (net.Listener, error) {
+	min, max := c.options.activePortMin, c.options.activePortMax
+	if min <= 0 || max < min {
+		return net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+	}
+	n := max - min + 1
+	start := rand.Intn(n)
+	var err error
+	for i := 0; i < n; i++ {
+		port := min + (start+i)%n
+		var ln net.Listener
+		ln, err = net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: port})
+		if err == nil {
+			return ln, nil
+		}
+	}
+	return nil, fmt.Errorf("no free port for active mode in %d-%d: %v", min, max, err)
+}
+
+// acceptActive waits for the server to open the data connection to
+// ln and closes ln.
+func (c *ServerConn) acceptActive(ln net.Listener) (net.Conn, error) {
+	defer ln.Close()
+	if timeout := c.options.dialer.Timeout; timeout > 0 {
+		_ = ln.(*net.TCPListener).SetDeadline(time.Now().Add(timeout))
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return c.wrapDataConn(conn), nil
+}
+
+// now returns the current time in the time zone of the server's
+// listings, which is UTC unless set with DialWithLocation.
+func (c *ServerConn) now() time.Time {
+	loc := c.options.location
+	if loc == nil {
+		loc = time.UTC
+	}
+	return time.Now().In(loc)
+}
+
+// CommandTimeoutError is returned when the server doesn't reply to
+// a command within the timeout set with DialWithCommandTimeout.
+type CommandTimeoutError struct {
+	Command  string        // the command without its arguments, eg "SIZE" or "SITE CHMOD"
+	Duration time.Duration // how long was waited for the reply
+}
+
+// Error implements the error interface.
+func (e *CommandTimeoutError) Error() string {
+	return fmt.Sprintf("no reply to %s within %v", e.Command, e.Duration)
+}
+
+// Timeout implements net.Error.
+func (e *CommandTimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary implements net.Error.
+func (e *CommandTimeoutError) Temporary() bool {
+	return true
+}
+
+// TransferReplyTimeoutError is returned when closing a transfer if
+// the server doesn't send its final reply within the timeout set with
+// DialWithTransferReplyTimeout.  The data connection was closed
+// without error before waiting for the reply, so an upload sent all
+// its data and a download read all the data the server sent.
+type TransferReplyTimeoutError struct {
+	Duration time.Duration // how long was waited for the reply
+}
+
+// Error implements the error interface.
+func (e *TransferReplyTimeoutError) Error() string {
+	return fmt.Sprintf("no reply to transfer within %v", e.Duration)
+}
+
+// Timeout implements net.Error.
+func (e *TransferReplyTimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary implements net.Error.
+func (e *TransferReplyTimeoutError) Temporary() bool {
+	return true
+}
+
+// InvalidCommandError is returned instead of sending a command
+// containing control characters, eg a path with a line break in it,
+// which the server could read as more than one command.
+type InvalidCommandError struct {
+	Command string // the command without its arguments, eg "STOR"
+}
+
+// Error implements the error interface.
+func (e *InvalidCommandError) Error() string {
+	return fmt.Sprintf("%s not sent as it contains control characters", e.Command)
+}
+
+// checkCommand returns an *InvalidCommandError if the command made
+// from format and args contains control characters other than tab
+func checkCommand(format string, args ...interface{}) error {
+	line := fmt.Sprintf(format, args...)
+	if strings.IndexFunc(line, func(r rune) bool { return r < ' ' && r != '\t' }) >= 0 {
+		return &InvalidCommandError{Command: commandName(format, args...)}
+	}
+	return nil
+}
+
+// commandName returns the name of the command made from format and
+// args without its arguments, which may be passwords, apart from the
+// name of a SITE command
+func commandName(format string, args ...interface{}) string {
+	fields := strings.Fields(fmt.Sprintf(format, args...))
+	switch {
+	case len(fields) == 0:
+		return ""
+	case len(fields) > 1 && strings.ToUpper(fields[0]) == "SITE":
+		return fields[0] + " " + fields[1]
+	}
+	return fields[0]
+}
+
+// cmd is a helper function to execute a command and check for the expected FTP
+// return code
+func (c *ServerConn) cmd(expected int, format string, args ...interface{}) (code int, message string, err error) {
+	if err = checkCommand(format, args...); err != nil {
+		return 0, "", err
+	}
+	if timeout := c.options.commandTimeout; timeout > 0 && c.netConn != nil {
+		if err = c.netConn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return 0, "", err
+		}
+		defer func() {
+			_ = c.netConn.SetDeadline(time.Time{})
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				err = &CommandTimeoutError{Command: commandName(format, args...), Duration: timeout}
+			}
+		}()
+	}
+
+	err = c.sendCmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return c.readResponse(expected)
+}
+
+// sendCmd sends a command converting it with the encoding if set
+func (c *ServerConn) sendCmd(format string, args ...interface{}) error {
+	if c.options.encode == nil {
+		_, err := c.conn.Cmd(format, args...)
+		return err
+	}
+	line, err := c.options.encode(fmt.Sprintf(format, args...))
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Cmd("%s", line)
+	return err
+}
+
+// readResponse reads a response converting its message with the
+// encoding if set
+func (c *ServerConn) readResponse(expected int) (int, string, error) {
+	code, msg, err := c.conn.ReadResponse(expected)
+	if textErr, ok := err.(*textproto.Error); ok {
+		textErr.Msg = c.decode(textErr.Msg)
+	}
+	return code, c.decode(msg), err
+}
+
+// decode converts text from the server with the encoding if set,
+// leaving it as it is if it can't be
+func (c *ServerConn) decode(text string) string {
+	if c.options.decode == nil {
+		return text
+	}
+	decoded, err := c.options.decode(text)
+	if err != nil {
+		return text
+	}
+	return decoded
+}
+
+// Quote issues a raw FTP command, such as a SITE command, on the control
+// connection.  The status code and message of the response are returned
+// without being checked so the caller must interpret them.
+func (c *ServerConn) Quote(format string, args ...interface{}) (int, string, error) {
+	return c.cmd(-1, format, args...)
+}
+
+// cmdDataConnFrom executes a command which require a FTP data connection.
+// Issues a REST FTP command to specify the number of bytes to skip for the transfer.
+func (c *ServerConn) cmdDataConnFrom(offset uint64, format string, args ...interface{}) (net.Conn, error) {
+	// Check the command before anything is sent for it
+	if err := checkCommand(format, args...); err != nil {
+		return nil, err
+	}
+	// In active mode conn is only set once the server has connected
+	// back, so close whichever of conn or ln is open on error
+	var conn net.Conn
+	var ln net.Listener
+	var err error
+	if c.options.activeMode {
+		ln, err = c.listenActive()
+	} else {
+		conn, err = c.openDataConn()
+	}
+	if err != nil {
+		return nil, err
+	}
+	closeData := func() {
+		if conn != nil {
+			conn.Close()
+		}
+		if ln != nil {
+			ln.Close()
+		}
+	}
+
+	if offset != 0 {
+		_, _, err := c.cmd(StatusRequestFilePending, "REST %d", offset)
+		if err != nil {
+			closeData()
+			return nil, err
+		}
+	}
+
+	err = c.sendCmd(format, args...)
+	if err != nil {
+		closeData()
+		return nil, err
+	}
+
+	code, msg, err := c.readResponse(-1)
+	if err != nil {
+		closeData()
+		return nil, err
+	}
+	if code != StatusAlreadyOpen && code != StatusAboutToSend {
+		closeData()
+		return nil, &textproto.Error{Code: code, Msg: msg}
+	}
+
+	if ln != nil {
+		return c.acceptActive(ln)
+	}
+	return conn, nil
+}
+
+// NameList issues an NLST FTP command.
+func (c *ServerConn) NameList(path string) (entries []string, err error) {
+	conn, err := c.cmdDataConnFrom(0, "NLST %s", path)
+	if err != nil {
+		return
+	}
+
+	r := &Response{conn: conn, c: c}
+	defer closeListing(r, &err)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		entries = append(entries, c.decode(scanner.Text()))
+	}
+	if err = scanner.Err(); err != nil {
+		return entries, err
+	}
+	return
+}
+
+// closeListing closes the data connection of a listing.  Errors in
+// the reply are ignored as the listing has been read, apart from it
+// timing out which is returned in *perr if it is nil as the
+// connection can't be used again.
+func closeListing(r *Response, perr *error) {
+	err := r.Close()
+	if _, ok := err.(*TransferReplyTimeoutError); ok && *perr == nil {
+		*perr = err
+	}
+}
+
+// List issues a LIST FTP command.
+func (c *ServerConn) List(path string) (entries []*Entry, err error) {
+	err = c.ListFunc(path, func(entry *Entry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ListFunc lists path like List but calls fn with each entry as it is
+// read rather than returning them all, so directories too big to hold
+// in memory can be listed.  The connection can't be used for anything
+// else until it returns.  If fn returns an error the rest of the
+// listing is abandoned and the error returned.
+func (c *ServerConn) ListFunc(path string, fn func(entry *Entry) error) (err error) {
+	var cmd string
+	var parser parseFunc
+
+	if c.mlstSupported {
+		cmd = "MLSD"
+		parser = parseRFC3659ListLine
+	} else {
+		cmd = "LIST"
+		if c.options.forceListHidden {
+			cmd += " -a"
+		}
+		parser = c.parseListLine
+	}
+
+	space := " "
+	if path == "" {
+		space = ""
+	}
+	conn, err := c.cmdDataConnFrom(0, "%s%s%s", cmd, space, path)
+	if err != nil {
+		return err
+	}
+
+	r := &Response{conn: conn, c: c}
+	defer closeListing(r, &err)
+
+	scanner := bufio.NewScanner(r)
+	now := c.now()
+	for scanner.Scan() {
+		entry, parseErr := parser(c.decode(scanner.Text()), now)
+		if parseErr != nil {
+			continue
+		}
+		if err = fn(entry); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// parseListLine parses a LIST line with the parsers chosen with
+// DialWithListParser or detects its format if none were
+func (c *ServerConn) parseListLine(line string, now time.Time) (*Entry, error) {
+	if c.options.listParsers == nil {
+		return parseListLine(line, now)
+	}
+	return parseListLineWith(c.options.listParsers, line, now)
+}
+
+// Stat issues a STAT FTP command with path, which lists it over the
+// control connection rather than a data connection.  Servers which
+// don't support STAT with a path may return no entries.
+func (c *ServerConn) Stat(path string) (entries []*Entry, err error) {
+	code, msg, err := c.cmd(-1, "STAT %s", path)
+	if err != nil {
+		return nil, err
+	}
+	switch code {
+	case StatusSystem, StatusDirectory, StatusFile:
+	default:
+		return nil, &textproto.Error{Code: code, Msg: msg}
+	}
+	// The listing is between the first and last lines of the reply
+	lines := strings.Split(msg, "\n")
+	if len(lines) < 3 {
+		return nil, nil
+	}
+	now := c.now()
+	for _, line := range lines[1 : len(lines)-1] {
+		entry, err := c.parseListLine(strings.TrimLeft(line, " "), now)
+		if err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// ChangeDir issues a CWD FTP command, which changes the current directory to
+// the specified path.
+func (c *ServerConn) ChangeDir(path string) error {
+	_, _, err := c.cmd(StatusRequestedFileActionOK, "CWD %s", path)
+	return err
+}
+
+// ChangeDirToParent issues a CDUP FTP command, which changes the current
+// directory to the parent directory.  This is similar to a call to ChangeDir
+// with a path set to "..".
+func (c *ServerConn) ChangeDirToParent() error {
+	_, _, err := c.cmd(StatusRequestedFileActionOK, "CDUP")
+	return err
+}
+
+// CurrentDir issues a PWD FTP command, which Returns the path of the current
+// directory.
+func (c *ServerConn) CurrentDir() (string, error) {
+	_, msg, err := c.cmd(StatusPathCreated, "PWD")
+	if err != nil {
+		return "", err
+	}
+
+	start := strings.Index(msg, "\"")
+	end := strings.LastIndex(msg, "\"")
+
+	if start == -1 || end == -1 {
+		return "", errors.New("Unsuported PWD response format")
+	}
+
+	return msg[start+1 : end], nil
+}
+
+// FileSize issues a SIZE FTP command, which Returns the size of the file
+func (c *ServerConn) FileSize(path string) (int64, error) {
+	_, msg, err := c.cmd(StatusFile, "SIZE %s", path)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := strconv.ParseInt(msg, 10, 64)
+	if err == nil && size < 0 {
+		return 0, fmt.Errorf("invalid size %q", msg)
+	}
+	return size, err
+}
+
+// GetEntry issues a MLST FTP command which retrieves one single Entry using the
+// control connection. The returnedEntry will describe the current directory
+// when no path is given.
+func (c *ServerConn) GetEntry(path string) (entry *Entry, err error) {
+	space := " "
+	if path == "" {
+		space = ""
+	}
+	_, msg, err := c.cmd(StatusRequestedFileActionOK, "%s%s%s", "MLST", space, path)
+	if err != nil {
+		return nil, err
+	}
+
+	// The expected reply will look something like:
+	//
+	//    250-File details
+	//     Type=file;Size=1024;Modify=20220813133357; path
+	//    250 End
+	lines := strings.Split(msg, "\n")
+	lc := len(lines)
+
+	// lines must be a multi-line message with a length of 3 or more, and we
+	// don't care about the first and last line
+	if lc < 3 {
+		return nil, errors.New("invalid response")
+	}
+
+	for _, l := range lines[1 : lc-1] {
+		// According to RFC 3659, the entry lines must start with a space when passed over the
+		// control connection. Some servers don't seem to add that space though. Both forms are
+		// accepted here.
+		if len(l) > 0 && l[0] == ' ' {
+			l = l[1:]
+		}
+		// Some severs seem to send a blank line at the end which we ignore
+		if l == "" {
+			continue
+		}
+		if entry, err = parseRFC3659ListLine(l, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	if entry == nil {
+		return nil, errors.New("invalid response")
+	}
+	return entry, nil
+}
+
+// GetTime issues the MDTM FTP command to obtain the file modification time.
+// It returns a UTC time.
+func (c *ServerConn) GetTime(path string) (time.Time, error) {
+	var t time.Time
+	_, msg, err := c.cmd(StatusFile, "MDTM %s", path)
+	if err != nil {
+		return t, err
+	}
+	return time.ParseInLocation("20060102150405", msg, time.UTC)
+}
+
+// SetTime issues the MFMT FTP command to set the file modification time.
+func (c *ServerConn) SetTime(path string, t time.Time) error {
+	utime := t.In(time.UTC).Format("20060102150405")
+	_, _, err := c.cmd(StatusFile, "MFMT %s %s", utime, path)
+	return err
+}
+
+// Retr issues a RETR FTP command to fetch the specified file from the remote
+// FTP server.
+//
+// The returned ReadCloser must be closed to cleanup the FTP data connection.
+func (c *ServerConn) Retr(path string) (*Response, error) {
+	return c.RetrFrom(path, 0)
+}
+
+// RetrFrom issues a RETR FTP command to fetch the specified file from the remote
+// FTP server, the server will not send the offset first bytes of the file.
+//
+// The returned ReadCloser must be closed to cleanup the FTP data connection.
+func (c *ServerConn) RetrFrom(path string, offset uint64) (*Response, error) {
+	conn, err := c.cmdDataConnFrom(offset, "RETR %s", path)
+	if errX, ok := err.(*textproto.Error); ok {
+		switch errX.Code {
+		case StatusClosingDataConnection, StatusRequestedFileActionOK:
+			// Some servers reply that the transfer is
+			// complete straight away for empty files
+			// without using the data connection
+			return &Response{c: c, closed: true}, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Response{conn: conn, c: c}, nil
+}
+
+// Stor issues a STOR FTP command to store a file to the remote FTP server.
+// Stor creates the specified file with the content of the io.Reader.
+//
+// Hint: io.Pipe() can be used if an io.Writer is required.
+func (c *ServerConn) Stor(path string, r io.Reader) error {
+	return c.StorFrom(path, r, 0)
+}
+
+// StorFrom issues a STOR FTP command to store a file to the remote FTP server.
+// Stor creates the specified file with the content of the io.Reader, writing
+// on the server will start at the given file offset.
+//
+// Hint: io.Pipe() can be used if an io.Writer is required.
+func (c *ServerConn) StorFrom(path string, r io.Reader, offset uint64) error {
+	conn, err := c.cmdDataConnFrom(offset, "STOR %s", path)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(conn, r)
+	if err == nil && n == 0 {
+		// If we wrote no bytes and got no error, make sure we call
+		// tls.Handshake on the connection as it won't get called
+		// unless Write() is called. (See comment in openDataConn()).
+		if do, ok := conn.(interface{ Handshake() error }); ok {
+			err = do.Handshake()
+		}
+	}
+	return c.finishUpload(conn, err)
+}
+
+// finishUpload closes the data connection of an upload, which tells
+// the server the data is complete, and reads the server response.
+//
+// The response is read even if the upload failed with err otherwise,
+// if the failure was the server refusing the data, eg for quota
+// limits, the connection can't be used for other commands.  err is
+// returned in preference to any error closing or in the response.
+func (c *ServerConn) finishUpload(conn net.Conn, err error) error {
+	if closeErr := conn.Close(); err == nil {
+		err = closeErr
+	}
+	respErr := c.readTransferReply()
+	if err == nil {
+		err = respErr
+	}
+	return err
+}
+
+// readTransferReply reads the final reply to a transfer, sent once
+// its data connection is closed, with the timeout set with
+// DialWithTransferReplyTimeout if any.
+func (c *ServerConn) readTransferReply() (err error) {
+	if timeout := c.options.replyTimeout; timeout > 0 && c.netConn != nil {
+		if err = c.netConn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+		defer func() {
+			_ = c.netConn.SetReadDeadline(time.Time{})
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				err = &TransferReplyTimeoutError{Duration: timeout}
+			}
+		}()
+	}
+	_, _, err = c.conn.ReadResponse(StatusClosingDataConnection)
+	return err
+}
+
+// Append issues a APPE FTP command to store a file to the remote FTP server.
+// If a file already exists with the given path, then the content of the
+// io.Reader is appended. Otherwise, a new file is created with that content.
+//
+// Hint: io.Pipe() can be used if an io.Writer is required.
+func (c *ServerConn) Append(path string, r io.Reader) error {
+	conn, err := c.cmdDataConnFrom(0, "APPE %s", path)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(conn, r)
+	return c.finishUpload(conn, err)
+}
+
+// Rename renames a file on the remote FTP server.
+func (c *ServerConn) Rename(from, to string) error {
+	if err := checkCommand("RNTO %s", to); err != nil {
+		return err
+	}
+	_, _, err := c.cmd(StatusRequestFilePending, "RNFR %s", from)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = c.cmd(StatusRequestedFileActionOK, "RNTO %s", to)
+	return err
+}
+
+// Delete issues a DELE FTP command to delete the specified file from the
+// remote FTP server.
+func (c *ServerConn) Delete(path string) error {
+	_, _, err := c.cmd(StatusRequestedFileActionOK, "DELE %s", path)
+	return err
+}
+
+// RemoveDirRecur deletes a non-empty folder recursively using
+// RemoveDir and Delete
+func (c *ServerConn) RemoveDirRecur(path string) error {
+	err := c.ChangeDir(path)
+	if err != nil {
+		return err
+	}
+	currentDir, err := c.CurrentDir()
+	if err != nil {
+		return err
+	}
+	entries, err := c.List(currentDir)
+	for _, entry := range entries {
+		if entry.Name != ".." && entry.Name != "." {
+			if entry.Type == EntryTypeFolder {
+				err = c.RemoveDirRecur(currentDir + "/" + entry.Name)
+				if err != nil {
+					return err
+				}
+			} else {
+				err = c.Delete(entry.Name)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	err = c.ChangeDirToParent()
+	if err != nil {
+		return err
+	}
+	err = c.RemoveDir(currentDir)
+	return err
+}
+
+// MakeDir issues a MKD FTP command to create the specified directory on the
+// remote FTP server.
+func (c *ServerConn) MakeDir(path string) error {
+	_, _, err := c.cmd(StatusPathCreated, "MKD %s", path)
+	return err
+}
+
+// RemoveDir issues a RMD FTP command to remove the specified directory from
+// the remote FTP server.
+func (c *ServerConn) RemoveDir(path string) error {
+	_, _, err := c.cmd(StatusRequestedFileActionOK, "RMD %s", path)
+	return err
+}
+
+// NoOp issues a NOOP FTP command.
+// NOOP has no effects and is usually used to prevent the remote FTP server to
+// close the otherwise idle connection.
+func (c *ServerConn) NoOp() error {
+	_, _, err := c.cmd(StatusCommandOK, "NOOP")
+	return err
+}
+
+// Logout issues a REIN FTP command to logout the current user.
+func (c *ServerConn) Logout() error {
+	_, _, err := c.cmd(StatusReady, "REIN")
+	return err
+}
+
+// Quit issues a QUIT FTP command to properly close the connection from the
+// remote FTP server.
+func (c *ServerConn) Quit() error {
+	c.conn.Cmd("QUIT")
+	return c.conn.Close()
+}
+
+// Read implements the io.Reader interface on a FTP data connection.
+func (r *Response) Read(buf []byte) (int, error) {
+	if r.conn == nil {
+		// the transfer completed without a data connection
+		return 0, io.EOF
+	}
+	return r.conn.Read(buf)
+}
+
+// Close implements the io.Closer interface on a FTP data connection.
+// After the first call, Close will do nothing and return nil.
+func (r *Response) Close() error {
+	if r.closed {
+		return nil
+	}
+	err := r.conn.Close()
+	err2 := r.c.readTransferReply()
+	if err2 != nil {
+		err = err2
+	}
+	r.closed = true
+	return err
+}
+
+// SetDeadline sets the deadlines associated with the connection.
+func (r *Response) SetDeadline(t time.Time) error {
+	if r.conn == nil {
+		return nil
+	}
+	return r.conn.SetDeadline(t)
+}
@@ -19,6 +19,19 @@ var listLineParsers = []parseFunc{
 	parseHostedFTPLine,
 }
 
+// ListParsers are the names of the LIST formats which can be chosen
+// with DialWithListParser instead of detecting the format of each line.
+var ListParsers = []string{"unix", "windows", "vms", "netware", "os400"}
+
+// listParsersByName are the parsers for each of ListParsers
+var listParsersByName = map[string][]parseFunc{
+	"unix":    {parseLsListLine, parseHostedFTPLine},
+	"windows": {parseDirListLine},
+	"vms":     {parseVMSListLine},
+	"netware": {parseNetwareListLine},
+	"os400":   {parseOS400ListLine},
+}
+
 var dirTimeFormats = []string{
 	"01-02-06  03:04PM",
 	"2006-01-02  15:04",
@@ -131,6 +144,10 @@ func parseLsListLine(line string, now time.Time) (*Entry, error) {
 		e.Type = EntryTypeFolder
 	case 'l':
 		e.Type = EntryTypeLink
+		if i := strings.Index(e.Name, " -> "); i > 0 {
+			e.Target = e.Name[i+4:]
+			e.Name = e.Name[:i]
+		}
 	default:
 		return nil, errors.New("Unknown entry type")
 	}
@@ -151,7 +168,7 @@ func parseDirListLine(line string, now time.Time) (*Entry, error) {
 	// Try various time formats that DIR might use, and stop when one works.
 	for _, format := range dirTimeFormats {
 		if len(line) > len(format) {
-			e.Time, err = time.Parse(format, line[:len(format)])
+			e.Time, err = time.ParseInLocation(format, line[:len(format)], now.Location())
 			if err == nil {
 				line = line[len(format):]
 				break
@@ -205,10 +222,134 @@ func parseHostedFTPLine(line string, now time.Time) (*Entry, error) {
 	return parseLsListLine(fields[0]+" 1 "+scanner.Remaining(), now)
 }
 
+// parseVMSListLine parses a directory line from an OpenVMS server.
+//
+// CII-MANUAL.TEX;1  213/216  29-JAN-1996 03:33:12  [ANONYMOU,ANONYMOUS]   (RWED,RWED,,)
+//
+// The version is removed from the name and directories lose their
+// .DIR extension.  Sizes are given in 512 byte blocks so are only
+// accurate to a block.
+func parseVMSListLine(line string, now time.Time) (*Entry, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return nil, errUnsupportedListLine
+	}
+	name := fields[0]
+	i := strings.LastIndex(name, ";")
+	if i <= 0 {
+		return nil, errUnsupportedListLine
+	}
+	if _, err := strconv.ParseUint(name[i+1:], 10, 32); err != nil {
+		return nil, errUnsupportedListLine
+	}
+	e := &Entry{
+		Name: name[:i],
+		Type: EntryTypeFile,
+	}
+	if strings.HasSuffix(strings.ToUpper(e.Name), ".DIR") {
+		e.Name = e.Name[:len(e.Name)-len(".DIR")]
+		e.Type = EntryTypeFolder
+	}
+	blocks := fields[1]
+	if i := strings.Index(blocks, "/"); i >= 0 {
+		blocks = blocks[:i]
+	}
+	size, err := strconv.ParseUint(blocks, 10, 64)
+	if err != nil {
+		return nil, errUnsupportedListLine
+	}
+	if e.Type == EntryTypeFile {
+		e.Size = size * 512
+	}
+	for _, format := range []string{"2-Jan-2006 15:04:05", "2-Jan-2006 15:04"} {
+		e.Time, err = time.ParseInLocation(format, fields[2]+" "+fields[3], now.Location())
+		if err == nil {
+			return e, nil
+		}
+	}
+	return nil, errUnsupportedListLine
+}
+
+// parseNetwareListLine parses a directory line from a Novell NetWare
+// server.
+//
+// d [R----F--] supervisor            512       Jan 16 18:53    login
+func parseNetwareListLine(line string, now time.Time) (*Entry, error) {
+	scanner := newScanner(line)
+	fields := scanner.NextFields(7)
+	if len(fields) < 7 || len(fields[0]) != 1 || !strings.HasPrefix(fields[1], "[") {
+		return nil, errUnsupportedListLine
+	}
+	e := &Entry{
+		Name: strings.TrimLeft(scanner.Remaining(), " "),
+	}
+	if e.Name == "" {
+		return nil, errUnsupportedListLine
+	}
+	switch fields[0] {
+	case "-":
+		e.Type = EntryTypeFile
+		if err := e.setSize(fields[3]); err != nil {
+			return nil, errUnsupportedListLine
+		}
+	case "d":
+		e.Type = EntryTypeFolder
+	default:
+		return nil, errUnsupportedListLine
+	}
+	if err := e.setTime(fields[4:7], now); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// parseOS400ListLine parses a directory line from an IBM i (OS/400)
+// server.
+//
+// QSYS            77824 02/23/00 15:09:55 *DIR       QSYS.LIB/
+// RCHADM          12345 07/11/17 13:21:00 *STMF      report.txt
+//
+// The object types which hold others are directories.  Lines without
+// a date, such as the members of a file, are unsupported.
+func parseOS400ListLine(line string, now time.Time) (*Entry, error) {
+	scanner := newScanner(line)
+	fields := scanner.NextFields(5)
+	if len(fields) < 5 || !strings.HasPrefix(fields[4], "*") {
+		return nil, errUnsupportedListLine
+	}
+	e := &Entry{
+		Name: strings.TrimSuffix(strings.TrimLeft(scanner.Remaining(), " "), "/"),
+	}
+	if e.Name == "" {
+		return nil, errUnsupportedListLine
+	}
+	switch fields[4] {
+	case "*DIR", "*LIB", "*FLR", "*FILE":
+		e.Type = EntryTypeFolder
+	default:
+		e.Type = EntryTypeFile
+		if err := e.setSize(fields[1]); err != nil {
+			return nil, errUnsupportedListLine
+		}
+	}
+	var err error
+	e.Time, err = time.ParseInLocation("01/02/06 15:04:05", fields[2]+" "+fields[3], now.Location())
+	if err != nil {
+		return nil, errUnsupportedListLine
+	}
+	return e, nil
+}
+
 // parseListLine parses the various non-standard format returned by the LIST
 // FTP command.
 func parseListLine(line string, now time.Time) (*Entry, error) {
-	for _, f := range listLineParsers {
+	return parseListLineWith(listLineParsers, line, now)
+}
+
+// parseListLineWith parses line with the first of parsers which
+// supports it
+func parseListLineWith(parsers []parseFunc, line string, now time.Time) (*Entry, error) {
+	for _, f := range parsers {
 		e, err := f(line, now)
 		if err != errUnsupportedListLine {
 			return e, err
@@ -217,16 +358,20 @@ func parseListLine(line string, now time.Time) (*Entry, error) {
 	return nil, errUnsupportedListLine
 }
 
+// setSize sets the size of e from str which is always decimal, even
+// if it is padded with leading zeros.
 func (e *Entry) setSize(str string) (err error) {
-	e.Size, err = strconv.ParseUint(str, 0, 64)
+	e.Size, err = strconv.ParseUint(str, 10, 64)
 	return
 }
 
+// setTime sets the time of e from the date fields of a listing read
+// in the location of now.
 func (e *Entry) setTime(fields []string, now time.Time) (err error) {
 	if strings.Contains(fields[2], ":") { // contains time
 		thisYear, _, _ := now.Date()
-		timeStr := fmt.Sprintf("%s %s %d %s GMT", fields[1], fields[0], thisYear, fields[2])
-		e.Time, err = time.Parse("_2 Jan 2006 15:04 MST", timeStr)
+		timeStr := fmt.Sprintf("%s %s %d %s", fields[1], fields[0], thisYear, fields[2])
+		e.Time, err = time.ParseInLocation("_2 Jan 2006 15:04", timeStr, now.Location())
 
 		/*
 			On unix, `info ls` shows:
@@ -248,8 +393,8 @@ func (e *Entry) setTime(fields []string, now time.Time) (err error) {
 		if len(fields[2]) != 4 {
 			return errors.New("Invalid year format in time string")
 		}
-		timeStr := fmt.Sprintf("%s %s %s 00:00 GMT", fields[1], fields[0], fields[2])
-		e.Time, err = time.Parse("_2 Jan 2006 15:04 MST", timeStr)
+		timeStr := fmt.Sprintf("%s %s %s 00:00", fields[1], fields[0], fields[2])
+		e.Time, err = time.ParseInLocation("_2 Jan 2006 15:04", timeStr, now.Location())
 	}
 	return
 }
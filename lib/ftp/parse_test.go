@@ -34,7 +34,7 @@ var listTests = []line{
 	{"-rw-r--r--   1 marketwired marketwired    12016 Mar 16  2016 2016031611G087802-001.newsml", "2016031611G087802-001.newsml", 12016, EntryTypeFile, newTime(2016, time.March, 16)},
 
 	{"-rwxr-xr-x    3 110      1002            1234567 Dec 02  2009 fileName", "fileName", 1234567, EntryTypeFile, newTime(2009, time.December, 2)},
-	{"lrwxrwxrwx   1 root     other          7 Jan 25 00:17 bin -> usr/bin", "bin -> usr/bin", 0, EntryTypeLink, newTime(thisYear, time.January, 25, 0, 17)},
+	{"lrwxrwxrwx   1 root     other          7 Jan 25 00:17 bin -> usr/bin", "bin", 0, EntryTypeLink, newTime(thisYear, time.January, 25, 0, 17)},
 
 	// Another ls style
 	{"drwxr-xr-x               folder        0 Aug 15 05:49 !!!-Tipp des Haus!", "!!!-Tipp des Haus!", 0, EntryTypeFolder, newTime(thisYear, time.August, 15, 5, 49)},
@@ -54,6 +54,8 @@ var listTests = []line{
 	{"modify=20150806235817;perm=fle;type=dir;unique=1B20F360U4;UNIX.group=0;UNIX.mode=0755;UNIX.owner=0; movies", "movies", 0, EntryTypeFolder, newTime(2015, time.August, 6, 23, 58, 17)},
 	{"modify=20150814172949;perm=flcdmpe;type=dir;unique=85A0C168U4;UNIX.group=0;UNIX.mode=0777;UNIX.owner=0; _upload", "_upload", 0, EntryTypeFolder, newTime(2015, time.August, 14, 17, 29, 49)},
 	{"modify=20150813175250;perm=adfr;size=951;type=file;unique=119FBB87UE;UNIX.group=0;UNIX.mode=0644;UNIX.owner=0; welcome.msg", "welcome.msg", 951, EntryTypeFile, newTime(2015, time.August, 13, 17, 52, 50)},
+	{"modify=20150813175250;size=0951;type=file; padded.msg", "padded.msg", 951, EntryTypeFile, newTime(2015, time.August, 13, 17, 52, 50)},
+	{"modify=20150813175250;size=10000000000000;type=file; large.bin", "large.bin", 10000000000000, EntryTypeFile, newTime(2015, time.August, 13, 17, 52, 50)},
 	// Format and types have first letter UpperCase
 	{"Modify=20150813175250;Perm=adfr;Size=951;Type=file;Unique=119FBB87UE;UNIX.group=0;UNIX.mode=0644;UNIX.owner=0; welcome.msg", "welcome.msg", 951, EntryTypeFile, newTime(2015, time.August, 13, 17, 52, 50)},
 
@@ -82,6 +84,76 @@ var listTestsFail = []unsupportedLine{
 	{"", "Unsupported LIST line"},
 }
 
+// listParserTests are lines in each of the formats of ListParsers
+// which are only parsed when the format is chosen
+var listParserTests = map[string][]line{
+	"unix": {
+		{"drwxr-xr-x    3 110      1002            3 Dec 02  2009 pub", "pub", 0, EntryTypeFolder, newTime(2009, time.December, 2)},
+		{"-r--------   0 user group     65222236 Feb 24 00:39 RegularFile", "RegularFile", 65222236, EntryTypeFile, newTime(thisYear, time.February, 24, 0, 39)},
+		// a file name which looks like an RFC 3659 fact
+		{"-rw-r--r--   1 owner    group          100 Jan 25 00:17 type=dir;x", "type=dir;x", 100, EntryTypeFile, newTime(thisYear, time.January, 25, 0, 17)},
+	},
+	"windows": {
+		{"08-07-15  07:50PM                  718 Post_PRR.dat", "Post_PRR.dat", 718, EntryTypeFile, newTime(2015, time.August, 7, 19, 50)},
+		{"08-10-15  02:04PM       <DIR>          Billing", "Billing", 0, EntryTypeFolder, newTime(2015, time.August, 10, 14, 4)},
+		{"2015-08-10  14:04               1024 data 2015.csv", "data 2015.csv", 1024, EntryTypeFile, newTime(2015, time.August, 10, 14, 4)},
+	},
+	"vms": {
+		{"CII-MANUAL.TEX;1  213/216  29-JAN-1996 03:33:12  [ANONYMOU,ANONYMOUS]   (RWED,RWED,,)", "CII-MANUAL.TEX", 213 * 512, EntryTypeFile, newTime(1996, time.January, 29, 3, 33, 12)},
+		{"PUB.DIR;1            1/3       7-OCT-2009 12:34  [SYSTEM]  (RWE,RWE,RE,RE)", "PUB", 0, EntryTypeFolder, newTime(2009, time.October, 7, 12, 34)},
+		{"LOGIN.COM;12         4        10-MAR-2017 09:05:00  [USER]", "LOGIN.COM", 4 * 512, EntryTypeFile, newTime(2017, time.March, 10, 9, 5)},
+	},
+	"netware": {
+		{"d [R----F--] supervisor            512       Jan 16 18:53    login", "login", 0, EntryTypeFolder, newTime(thisYear, time.January, 16, 18, 53)},
+		{"- [R----F--] rhesus             214059       Oct 20 15:27    cx.exe", "cx.exe", 214059, EntryTypeFile, newTime(previousYear, time.October, 20, 15, 27)},
+		{"- [RWCEAFMS] admin                 12       Mar 10  2015    read me.txt", "read me.txt", 12, EntryTypeFile, newTime(2015, time.March, 10)},
+	},
+	"os400": {
+		{"QSYS            77824 02/23/00 15:09:55 *DIR       QSYS.LIB/", "QSYS.LIB", 0, EntryTypeFolder, newTime(2000, time.February, 23, 15, 9, 55)},
+		{"QDOC           253952 04/26/01 12:23:57 *FLR       QDOC/", "QDOC", 0, EntryTypeFolder, newTime(2001, time.April, 26, 12, 23, 57)},
+		{"RCHADM          12345 07/11/17 13:21:00 *STMF      report 2017.txt", "report 2017.txt", 12345, EntryTypeFile, newTime(2017, time.July, 11, 13, 21)},
+	},
+}
+
+// listParserTestsFail are lines which aren't in the chosen format
+var listParserTestsFail = map[string][]string{
+	"unix":    {"08-10-15  02:04PM       <DIR>          Billing", "modify=20150813175250;size=951;type=file; welcome.msg"},
+	"windows": {"drwxr-xr-x    3 110      1002            3 Dec 02  2009 pub"},
+	"vms":     {"Directory ANONYMOUS_ROOT:[000000]", "Total of 3 files, 218/225 blocks.", "README;X  1  29-JAN-1996 03:33:12"},
+	"netware": {"drwxr-xr-x    3 110      1002            3 Dec 02  2009 pub", "total 1"},
+	"os400":   {"QSYS                                    *MEM       FILE.FILE/MBR.MBR", "drwxr-xr-x    3 110      1002            3 Dec 02  2009 pub"},
+}
+
+func TestListParsers(t *testing.T) {
+	for _, name := range ListParsers {
+		c := &ServerConn{options: &dialOptions{}}
+		DialWithListParser(name).setup(c.options)
+		for _, lt := range listParserTests[name] {
+			entry, err := c.parseListLine(lt.line, now)
+			if err != nil {
+				t.Errorf("%s: parseListLine(%v) returned err = %v", name, lt.line, err)
+				continue
+			}
+			if entry.Name != lt.name || entry.Type != lt.entryType || entry.Size != lt.size || !entry.Time.Equal(lt.time) {
+				t.Errorf("%s: parseListLine(%v) = %+v, want %q %v %d %v", name, lt.line, entry, lt.name, lt.entryType, lt.size, lt.time)
+			}
+		}
+		for _, line := range listParserTestsFail[name] {
+			if _, err := c.parseListLine(line, now); err == nil {
+				t.Errorf("%s: parseListLine(%v) expected to fail", name, line)
+			}
+		}
+	}
+
+	// without a parser the format is detected
+	c := &ServerConn{options: &dialOptions{}}
+	DialWithListParser("").setup(c.options)
+	entry, err := c.parseListLine("modify=20150813175250;size=951;type=file; welcome.msg", now)
+	if err != nil || entry.Name != "welcome.msg" {
+		t.Errorf("parseListLine detecting the format = %+v, %v", entry, err)
+	}
+}
+
 func TestParseValidListLine(t *testing.T) {
 	for _, lt := range listTests {
 		entry, err := parseListLine(lt.line, now)
@@ -144,6 +216,37 @@ func TestSettime(t *testing.T) {
 	}
 }
 
+func TestSettimeLocation(t *testing.T) {
+	// just after New Year in UTC
+	now := newTime(2017, time.January, 1, 0, 30)
+	tests := []struct {
+		offset   int
+		line     string
+		expected time.Time
+	}{
+		// still the previous year on the server
+		{-5 * 3600, "Dec 31 19:00", newTime(2017, time.January, 1)},
+		{-5 * 3600, "Dec 31 18:00", newTime(2016, time.December, 31, 23)},
+
+		// already New Year on the server
+		{2 * 3600, "Jan  1 02:00", newTime(2017, time.January, 1)},
+		{2 * 3600, "Dec 31 23:00", newTime(2016, time.December, 31, 21)},
+
+		// dates with a year are midnight on the server
+		{2 * 3600, "Jan 23  2016", newTime(2016, time.January, 22, 22)},
+	}
+
+	for _, test := range tests {
+		loc := time.FixedZone("", test.offset)
+		entry := &Entry{}
+		entry.setTime(strings.Fields(test.line), now.In(loc))
+
+		if !entry.Time.Equal(test.expected) {
+			t.Errorf("setTime(%v) in %v = %v, want %v", test.line, loc, entry.Time.UTC(), test.expected)
+		}
+	}
+}
+
 // newTime builds a UTC time from the given year, month, day, hour and minute
 func newTime(year int, month time.Month, day int, hourMinSec ...int) time.Time {
 	var hour, min, sec int